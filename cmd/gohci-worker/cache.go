@@ -0,0 +1,63 @@
+// Copyright 2020 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+)
+
+// maxCachedResults is the maximum number of results to remember.
+const maxCachedResults = 1000
+
+// resultCache remembers the cache keys of the successful builds.
+//
+// It is persisted on disk so it survives restarts.
+type resultCache struct {
+	path string
+
+	mu   sync.Mutex
+	keys []string // From the oldest to the most recent
+}
+
+// loadResultCache loads the cache from path, if present.
+func loadResultCache(path string) *resultCache {
+	r := &resultCache{path: path}
+	if b, err := ioutil.ReadFile(path); err == nil {
+		for _, l := range strings.Split(string(b), "\n") {
+			if l != "" {
+				r.keys = append(r.keys, l)
+			}
+		}
+	}
+	return r
+}
+
+// has returns true if the key is in the cache.
+func (r *resultCache) has(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, k := range r.keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// add adds the key to the cache, evicting the oldest ones if necessary.
+func (r *resultCache) add(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys = append(r.keys, key)
+	if len(r.keys) > maxCachedResults {
+		r.keys = r.keys[len(r.keys)-maxCachedResults:]
+	}
+	if err := ioutil.WriteFile(r.path, []byte(strings.Join(r.keys, "\n")+"\n"), 0600); err != nil {
+		log.Printf("Failed to save %s: %v", r.path, err)
+	}
+}
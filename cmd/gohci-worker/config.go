@@ -37,9 +37,46 @@ func loadConfig(fileName string) (*gohci.WorkerConfig, error) {
 	if c.Name == "" || c.WebHookSecret == "" {
 		return nil, rewrite(fileName, c)
 	}
+	switch c.CombinedStatus {
+	case "", "defer", "wait":
+	default:
+		return nil, fmt.Errorf("invalid combinedstatus %q", c.CombinedStatus)
+	}
+	if c.AdaptiveTimeout.Multiplier < 0 || c.AdaptiveTimeout.Max < 0 || c.AdaptiveTimeout.MinSamples < 0 {
+		return nil, fmt.Errorf("invalid adaptivetimeout %+v", c.AdaptiveTimeout)
+	}
+	if err = resolveTemplates(c); err != nil {
+		return nil, err
+	}
 	return c, nil
 }
 
+// resolveTemplates merges the templates into the repositories configuration
+// that reference them.
+func resolveTemplates(c *gohci.WorkerConfig) error {
+	for name, r := range c.Repos {
+		if r.Template == "" {
+			continue
+		}
+		t, ok := c.Templates[r.Template]
+		if !ok {
+			return fmt.Errorf("repo %q: unknown template %q", name, r.Template)
+		}
+		if t.Template != "" {
+			return fmt.Errorf("template %q: a template cannot inherit from another template", r.Template)
+		}
+		if r.Checks == nil {
+			r.Checks = t.Checks
+		}
+		if r.SecretsCmd == nil {
+			r.SecretsCmd = t.SecretsCmd
+		}
+		r.Env = append(append([]string(nil), t.Env...), r.Env...)
+		c.Repos[name] = r
+	}
+	return nil
+}
+
 func rewrite(fileName string, c *gohci.WorkerConfig) error {
 	// Defer these since they require actual work.
 	if c.WebHookSecret == "" {
@@ -0,0 +1,53 @@
+// Copyright 2020 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"periph.io/x/gohci"
+)
+
+func TestResolveTemplates(t *testing.T) {
+	test := []gohci.Check{{Cmd: []string{"go", "test", "./..."}}}
+	vet := []gohci.Check{{Cmd: []string{"go", "vet", "./..."}}}
+	c := &gohci.WorkerConfig{
+		Templates: map[string]gohci.RepoConfig{
+			"go": {Checks: test, Env: []string{"A=1"}},
+		},
+		Repos: map[string]gohci.RepoConfig{
+			"o/a": {Template: "go"},
+			"o/b": {Template: "go", Checks: vet, Env: []string{"B=2"}},
+			"o/c": {Checks: vet},
+		},
+	}
+	if err := resolveTemplates(c); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]gohci.RepoConfig{
+		"o/a": {Template: "go", Checks: test, Env: []string{"A=1"}},
+		"o/b": {Template: "go", Checks: vet, Env: []string{"A=1", "B=2"}},
+		"o/c": {Checks: vet},
+	}
+	if !reflect.DeepEqual(c.Repos, expected) {
+		t.Fatalf("unexpected %#v", c.Repos)
+	}
+}
+
+func TestResolveTemplates_Error(t *testing.T) {
+	data := []*gohci.WorkerConfig{
+		{Repos: map[string]gohci.RepoConfig{"o/a": {Template: "missing"}}},
+		{
+			Templates: map[string]gohci.RepoConfig{"a": {}, "b": {Template: "a"}},
+			Repos:     map[string]gohci.RepoConfig{"o/a": {Template: "b"}},
+		},
+	}
+	for i, c := range data {
+		if err := resolveTemplates(c); err == nil {
+			t.Fatalf("#%d: expected error", i)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"periph.io/x/gohci"
+)
+
+// maxDurations is the maximum number of durations to remember per check.
+const maxDurations = 20
+
+// minAdaptiveTimeout is the lowest adaptive timeout, so fast checks are not
+// killed because of normal jitter.
+const minAdaptiveTimeout = time.Minute
+
+// durationHistory remembers the durations of the recent successful runs of
+// each check to derive their timeout.
+//
+// It is persisted on disk so it survives restarts.
+type durationHistory struct {
+	path string
+	c    gohci.AdaptiveTimeout
+
+	mu        sync.Mutex
+	durations map[string][]time.Duration // From the oldest to the most recent
+}
+
+// loadDurationHistory loads the history from path, if present.
+func loadDurationHistory(path string, c gohci.AdaptiveTimeout) *durationHistory {
+	h := &durationHistory{path: path, c: c, durations: map[string][]time.Duration{}}
+	if b, err := ioutil.ReadFile(path); err == nil {
+		if err = json.Unmarshal(b, &h.durations); err != nil {
+			log.Printf("Failed to load %s: %v", path, err)
+		}
+	}
+	return h
+}
+
+// timeout returns the timeout to use for the check, 0 if none.
+func (h *durationHistory) timeout(key string) time.Duration {
+	h.mu.Lock()
+	d := h.durations[key]
+	h.mu.Unlock()
+	min := h.c.MinSamples
+	if min <= 0 {
+		min = 5
+	}
+	if len(d) < min {
+		return h.c.Max
+	}
+	t := time.Duration(float64(percentile95(d)) * h.c.Multiplier)
+	if t < minAdaptiveTimeout {
+		t = minAdaptiveTimeout
+	}
+	if h.c.Max > 0 && t > h.c.Max {
+		t = h.c.Max
+	}
+	return t
+}
+
+// add adds the duration of a successful run of the check.
+func (h *durationHistory) add(key string, d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	l := append(h.durations[key], d)
+	if len(l) > maxDurations {
+		l = l[len(l)-maxDurations:]
+	}
+	h.durations[key] = l
+	b, err := json.Marshal(h.durations)
+	if err == nil {
+		err = ioutil.WriteFile(h.path, b, 0600)
+	}
+	if err != nil {
+		log.Printf("Failed to save %s: %v", h.path, err)
+	}
+}
+
+// percentile95 returns the 95th percentile of the durations, using the
+// nearest-rank method.
+func percentile95(d []time.Duration) time.Duration {
+	if len(d) == 0 {
+		return 0
+	}
+	s := append([]time.Duration(nil), d...)
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	return s[int(math.Ceil(0.95*float64(len(s))))-1]
+}
@@ -0,0 +1,73 @@
+// Copyright 2020 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"periph.io/x/gohci"
+)
+
+func TestPercentile95(t *testing.T) {
+	data := []struct {
+		in       []time.Duration
+		expected time.Duration
+	}{
+		{nil, 0},
+		{[]time.Duration{time.Second}, time.Second},
+		{[]time.Duration{3 * time.Second, time.Second, 2 * time.Second}, 3 * time.Second},
+	}
+	for i, l := range data {
+		if d := percentile95(l.in); d != l.expected {
+			t.Fatalf("#%d: percentile95(%v) = %s; not %s", i, l.in, d, l.expected)
+		}
+	}
+	// With 20 samples, the 95th percentile is the 19th.
+	var in []time.Duration
+	for i := 20; i > 0; i-- {
+		in = append(in, time.Duration(i)*time.Second)
+	}
+	if d := percentile95(in); d != 19*time.Second {
+		t.Fatalf("percentile95(%v) = %s", in, d)
+	}
+	if in[0] != 20*time.Second {
+		t.Fatal("input modified")
+	}
+}
+
+func TestDurationHistory(t *testing.T) {
+	d, err := ioutil.TempDir("", "gohci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	path := filepath.Join(d, "durations.json")
+	c := gohci.AdaptiveTimeout{Multiplier: 5, Max: time.Hour, MinSamples: 2}
+
+	h := loadDurationHistory(path, c)
+	if to := h.timeout("a"); to != time.Hour {
+		t.Fatalf("expected the ceiling without samples, got %s", to)
+	}
+	h.add("a", 30*time.Second)
+	h.add("a", 40*time.Second)
+	if to := h.timeout("a"); to != 200*time.Second {
+		t.Fatalf("unexpected timeout %s", to)
+	}
+	h.add("b", time.Second)
+	h.add("b", time.Second)
+	if to := h.timeout("b"); to != minAdaptiveTimeout {
+		t.Fatalf("unexpected timeout %s", to)
+	}
+
+	// Reloaded from disk.
+	h = loadDurationHistory(path, gohci.AdaptiveTimeout{Multiplier: 1000, Max: time.Hour, MinSamples: 2})
+	if to := h.timeout("a"); to != time.Hour {
+		t.Fatalf("expected the ceiling, got %s", to)
+	}
+}
@@ -5,12 +5,21 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -24,6 +33,10 @@ import (
 
 var muCmd sync.Mutex
 
+// muCache is held in read mode by checks and in write mode by the ones
+// clearing the Go caches shared by all the builds.
+var muCache sync.RWMutex
+
 // normalizeUTF8 returns valid UTF8 from potentially incorrectly encoded data
 // from an untrusted process.
 func normalizeUTF8(b []byte) []byte {
@@ -69,12 +82,12 @@ func roundSize(t uint64) string {
 	return fmt.Sprintf("%d%s", t, orders[i])
 }
 
-// Wrap the exec.Command() call with PATH value override.
+// Wrap the exec.CommandContext() call with PATH value override.
 //
-// exec.Command() calls exec.Lookup() right away, and there is no way to
+// exec.CommandContext() calls exec.Lookup() right away, and there is no way to
 // override the PATH variable used by exec.Lookup(), so the process' value
 // must be temporarily changed.
-func getCmd(path string, cmd []string) *exec.Cmd {
+func getCmd(ctx context.Context, path string, cmd []string) *exec.Cmd {
 	muCmd.Lock()
 	defer muCmd.Unlock()
 	if path != "" {
@@ -85,7 +98,38 @@ func getCmd(path string, cmd []string) *exec.Cmd {
 			_ = os.Setenv("PATH", oldpath)
 		}()
 	}
-	return exec.Command(cmd[0], cmd[1:]...)
+	return exec.CommandContext(ctx, cmd[0], cmd[1:]...)
+}
+
+// runCmd runs the command created with getCmd and kills its whole process
+// group when ctx is done.
+//
+// exec.CommandContext only kills the direct child, so a grandchild would
+// otherwise keep the output pipe open and Wait() would block until it exits.
+func runCmd(ctx context.Context, c *exec.Cmd) error {
+	setProcessGroup(c)
+	if err := c.Start(); err != nil {
+		return err
+	}
+	stop := killOnDone(ctx, c)
+	defer stop()
+	return c.Wait()
+}
+
+// killOnDone kills the process group of the started command when ctx is done,
+// until stop is called.
+func killOnDone(ctx context.Context, c *exec.Cmd) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(c)
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+	}
 }
 
 // gistFile is an item in the gist.
@@ -96,10 +140,21 @@ type gistFile struct {
 	name, content string
 	success       bool
 	d             time.Duration
+	check         int  // 1 based index of the check, 0 for the setup steps
+	skipped       bool // The check was not run
 }
 
 //
 
+// jobOptions are the optional details of a job request.
+type jobOptions struct {
+	ref           string        // Git ref that triggered the job if known, e.g. "refs/heads/master"
+	defaultBranch string        // Default branch of the repository, if known
+	files         []string      // Files changed by the commit, nil if unknown
+	checks        []gohci.Check // Checks to run instead of the repository's ones, if set
+	create        bool          // Triggered by a branch or tag creation
+}
+
 // jobRequest is the details to run a verification job.
 //
 // It defines a github repository being tested in the worker gohci.yml
@@ -111,10 +166,21 @@ type jobRequest struct {
 	commitHash string // commit hash, not a ref
 	useSSH     bool   // useSSH tells to use ssh instead of https
 	pullID     int    // pullID is the PR ID if relevant
+	seq        int64  // Logical order in which the job requests were enqueued
+	gistID     string // ID of the gist holding the results, if created
+
+	jobOptions
+	gitSem    chan struct{}    // Limits concurrent git network operations, if set
+	durations *durationHistory // Used to derive the checks timeout, if set
 
 	gopath string   // Cache of GOPATH
 	path   string   // Cache of PATH
 	env    []string // Precomputed environment variables
+	hidden []string // Secret values to redact from the output
+
+	ctx        context.Context    // Canceled when the job is canceled
+	cancel     context.CancelFunc // Cancels ctx
+	cancelDesc string             // Status description to use when canceled; set before calling cancel
 }
 
 // newJobRequest creates a new test request for project 'org/repo' on commitHash
@@ -140,6 +206,7 @@ func newJobRequest(org, repo, altPath, commitHash string, useSSH bool, pullID in
 		env = append(env, "GIT_SHA="+commitHash)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	return &jobRequest{
 		org:        org,
 		repo:       repo,
@@ -150,6 +217,8 @@ func newJobRequest(org, repo, altPath, commitHash string, useSSH bool, pullID in
 		gopath:     gopath,
 		path:       path,
 		env:        env,
+		ctx:        ctx,
+		cancel:     cancel,
 	}
 }
 
@@ -181,12 +250,13 @@ func (j *jobRequest) getID() string {
 	return j.org + "/" + j.repo
 }
 
-// findCommitHash tries to get the HEAD commit for the PR # or default branch.
+// findCommitHash tries to get the HEAD commit for the PR #, the ref or the
+// default branch.
 func (j *jobRequest) findCommitHash() bool {
 	if err := j.assertDir(); err != nil {
 		return false
 	}
-	stdout, ok := j.run("", nil, []string{"git", "ls-remote", j.cloneURL()}, false)
+	stdout, ok := j.runNetwork("", []string{"git", "ls-remote", j.cloneURL()})
 	if !ok {
 		log.Printf("  git ls-remote failed:\n%s", stdout)
 		return false
@@ -194,12 +264,19 @@ func (j *jobRequest) findCommitHash() bool {
 	p := "HEAD"
 	if j.pullID != 0 {
 		p = fmt.Sprintf("refs/pull/%d/head", j.pullID)
+	} else if j.ref != "" {
+		p = j.ref
 	}
-	for _, l := range strings.Split(stdout, "\n") {
-		if strings.HasSuffix(l, p) {
-			j.commitHash = strings.SplitN(l, "\t", 2)[0]
-			log.Printf("  Found %s for PR #%d", j.commitHash, j.pullID)
-			return true
+	lines := strings.Split(stdout, "\n")
+	// Look for the peeled commit of an annotated tag first, otherwise the tag
+	// object would be found.
+	for _, suffix := range []string{"\t" + p + "^{}", "\t" + p} {
+		for _, l := range lines {
+			if strings.HasSuffix(l, suffix) {
+				j.commitHash = strings.SplitN(l, "\t", 2)[0]
+				log.Printf("  Found %s for %s", j.commitHash, p)
+				return true
+			}
 		}
 	}
 	log.Printf("  Didn't find remote")
@@ -221,8 +298,14 @@ func (j *jobRequest) metadata() string {
 
 // run runs an executable and returns mangled merged stdout+stderr.
 //
-// Use pathOverride when running checks.
-func (j *jobRequest) run(relwd string, env, cmd []string, pathOverride bool) (string, bool) {
+// Use pathOverride when running checks. Use tty to run the executable under a
+// pseudo-terminal.
+func (j *jobRequest) run(relwd string, env, cmd []string, pathOverride, tty bool) (string, bool) {
+	return j.runContext(j.ctx, relwd, env, cmd, pathOverride, tty)
+}
+
+// runContext is run with a context derived from j.ctx, e.g. with a timeout.
+func (j *jobRequest) runContext(ctx context.Context, relwd string, env, cmd []string, pathOverride, tty bool) (string, bool) {
 	// Keep a copy of the one off environment variables, as we'll print them
 	// later.
 	dbg := strings.Join(env, " ")
@@ -253,33 +336,109 @@ func (j *jobRequest) run(relwd string, env, cmd []string, pathOverride bool) (st
 		dbg += " "
 	}
 	dbg += strings.Join(cmd, " ")
+	dbg = j.redact(dbg)
 	log.Printf("- relwd=%s : %s", relwd, dbg)
 
 	var c *exec.Cmd
 	if pathOverride {
-		c = getCmd(j.path, cmd)
+		c = getCmd(ctx, j.path, cmd)
 	} else {
-		c = getCmd("", cmd)
+		c = getCmd(ctx, "", cmd)
 	}
 	c.Env = env
 	c.Dir = filepath.Join(j.gopath, relwd)
 	start := time.Now()
-	out, err := c.CombinedOutput()
+	var out []byte
+	var err error
+	if tty {
+		out, err = runPTY(ctx, c)
+	} else {
+		buf := bytes.Buffer{}
+		c.Stdout = &buf
+		c.Stderr = &buf
+		err = runCmd(ctx, c)
+		out = buf.Bytes()
+	}
 	duration := time.Since(start)
 	exit := 0
 	if err != nil {
 		exit = -1
-		if len(out) == 0 {
-			out = []byte("<failure>\n" + err.Error() + "\n")
-		}
+		killed := ""
 		if exiterr, ok := err.(*exec.ExitError); ok {
 			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
 				exit = status.ExitStatus()
+				if status.Signaled() {
+					killed = "killed by signal " + status.Signal().String()
+				}
+			}
+		}
+		if j.ctx.Err() != nil {
+			killed = "killed since the job was canceled"
+		} else if ctx.Err() == context.DeadlineExceeded {
+			killed = "killed since it timed out"
+		}
+		if len(out) == 0 {
+			// Always give something actionable.
+			out = []byte(fmt.Sprintf("<failure without output>\nerror:   %s\nexit:    %d\ncommand: %s\ncwd:     %s\n", err, exit, dbg, c.Dir))
+			if killed != "" {
+				out = append(out, killed+"\n"...)
 			}
 		}
 	}
 	return fmt.Sprintf("%s $ %s  (exit:%d in %s)\n%s",
-		filepath.Join("$GOPATH/src", relwd), dbg, exit, roundDuration(duration), normalizeUTF8(out)), err == nil
+		filepath.Join("$GOPATH/src", relwd), dbg, exit, roundDuration(duration), j.redact(string(normalizeUTF8(out)))), err == nil
+}
+
+// runNetwork runs a git command that accesses the remote, limiting the number of
+// concurrent ones.
+func (j *jobRequest) runNetwork(relwd string, cmd []string) (string, bool) {
+	if j.gitSem != nil {
+		select {
+		case j.gitSem <- struct{}{}:
+		case <-j.ctx.Done():
+			return "<canceled>\n", false
+		}
+		defer func() {
+			<-j.gitSem
+		}()
+	}
+	return j.run(relwd, nil, cmd, false, false)
+}
+
+// output runs an executable and returns its trimmed stdout.
+func (j *jobRequest) output(relwd string, cmd []string) (string, error) {
+	c := getCmd(j.ctx, j.path, cmd)
+	c.Env = j.env
+	c.Dir = filepath.Join(j.gopath, relwd)
+	buf := bytes.Buffer{}
+	c.Stdout = &buf
+	err := runCmd(j.ctx, c)
+	return strings.TrimSpace(buf.String()), err
+}
+
+// minRedactLen is the minimum length of a secret value to redact it from the
+// output. Shorter values, e.g. "1", would mangle the output.
+const minRedactLen = 4
+
+// addSecrets adds the secrets to the environment and remembers their values to
+// redact them from the output.
+func (j *jobRequest) addSecrets(secrets []string) {
+	for _, s := range secrets {
+		j.env = append(j.env, s)
+		if v := s[strings.IndexByte(s, '=')+1:]; len(v) >= minRedactLen {
+			j.hidden = append(j.hidden, v)
+		} else if v != "" {
+			log.Printf("- secret %s is too short to be redacted", s[:strings.IndexByte(s, '=')])
+		}
+	}
+}
+
+// redact replaces the secret values in s.
+func (j *jobRequest) redact(s string) string {
+	for _, h := range j.hidden {
+		s = strings.Replace(s, h, "<redacted>", -1)
+	}
+	return s
 }
 
 func (j *jobRequest) assertDir() error {
@@ -316,20 +475,37 @@ func (j *jobRequest) checkout() (string, bool) {
 	out := ""
 	ok := true
 	for _, c := range setupCmds {
-		stdout, ok2 := j.run(p, nil, c, false)
+		var stdout string
+		var ok2 bool
+		if c[1] == "fetch" {
+			stdout, ok2 = j.runNetwork(p, c)
+		} else {
+			stdout, ok2 = j.run(p, nil, c, false, false)
+		}
 		out += stdout
 		if ok = ok && ok2; !ok {
 			break
 		}
 	}
+	if ok {
+		// Make sure the right commit is tested, e.g. the PR may have been updated
+		// in the meantime.
+		head, err := j.output(p, []string{"git", "rev-parse", "HEAD"})
+		if err != nil {
+			out += "git rev-parse HEAD failed: " + err.Error() + "\n"
+			ok = false
+		} else if head != j.commitHash {
+			out += fmt.Sprintf("checked out %s but expected %s\n", head, j.commitHash)
+			ok = false
+		}
+	}
 	return out, ok
-
 }
 
 // parseConfig is the third part of a job.
 //
-// It reads the ".gohci.yml" if there's one.
-func (j *jobRequest) parseConfig(name string) ([]gohci.Check, string) {
+// It reads the ".gohci.yml" if there's one. Otherwise it uses def if set.
+func (j *jobRequest) parseConfig(name string, def []gohci.Check) ([]gohci.Check, string) {
 	if p := loadProjectConfig(filepath.Join(j.gopath, "src", j.getPath(), ".gohci.yml")); p != nil {
 		for _, w := range p.Workers {
 			if w.Name == name {
@@ -342,15 +518,143 @@ func (j *jobRequest) parseConfig(name string) ([]gohci.Check, string) {
 			}
 		}
 	}
+	if len(def) != 0 {
+		return def, "Using the worker's checks for the repo"
+	}
 	// Returns the default.
 	return []gohci.Check{{Cmd: []string{"go", "test", "./..."}}}, "Using default check"
 }
 
+// treeHash returns the hash of the checked out source tree.
+func (j *jobRequest) treeHash() (string, error) {
+	return j.output(filepath.Join("src", j.getPath()), []string{"git", "rev-parse", "HEAD^{tree}"})
+}
+
+// goVersion returns the version of the Go toolchain used by the checks.
+func (j *jobRequest) goVersion() (string, error) {
+	return j.output(filepath.Join("src", j.getPath()), []string{"go", "version"})
+}
+
+// cacheKey returns the key identifying the result of running the checks.
+//
+// It is composed of the source tree, the Go toolchain version, the environment
+// and the checks that are run, so any change to these invalidates the cached
+// result.
+func (j *jobRequest) cacheKey(checks []gohci.Check) (string, error) {
+	tree, err := j.treeHash()
+	if err != nil {
+		return "", err
+	}
+	v, err := j.goVersion()
+	if err != nil {
+		return "", err
+	}
+	// Skipped checks depend on the event, not the tree.
+	var run []gohci.Check
+	for _, c := range checks {
+		if j.skipReason(c.When) == "" {
+			run = append(run, c)
+		}
+	}
+	b, err := json.Marshal(run)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n", tree, v, b)
+	for _, e := range j.cacheEnv() {
+		fmt.Fprintf(h, "%s\n", e)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// cacheEnv returns the sorted environment to include in the cache key.
+//
+// GIT_SHA is excluded since the same tree can be at different commits. The
+// secrets values are replaced with their hash.
+func (j *jobRequest) cacheEnv() []string {
+	out := make([]string, 0, len(j.env))
+	for _, e := range j.env {
+		if strings.HasPrefix(e, "GIT_SHA=") {
+			continue
+		}
+		i := strings.IndexByte(e, '=') + 1
+		for _, h := range j.hidden {
+			if e[i:] == h {
+				s := sha256.Sum256([]byte(h))
+				e = e[:i] + "sha256:" + hex.EncodeToString(s[:])
+				break
+			}
+		}
+		out = append(out, e)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// buildManifest is the reproducibility manifest of a build.
+type buildManifest struct {
+	Version   int // Currently 1
+	Repo      string
+	Commit    string
+	Tree      string
+	GoVersion string
+	Modules   []string `json:",omitempty"` // Empty when not a Go module
+	Env       []string
+	Checks    []gohci.Check
+}
+
+// manifest generates the reproducibility manifest of the build as JSON.
+func (j *jobRequest) manifest(checks []gohci.Check) (string, bool) {
+	p := filepath.Join("src", j.getPath())
+	m := buildManifest{
+		Version: 1,
+		Repo:    j.getID(),
+		Commit:  j.commitHash,
+		Env:     redactEnv(j.env),
+		Checks:  checks,
+	}
+	var errs []string
+	var err error
+	if m.Tree, err = j.treeHash(); err != nil {
+		errs = append(errs, "git rev-parse failed: "+err.Error())
+	}
+	if m.GoVersion, err = j.goVersion(); err != nil {
+		errs = append(errs, "go version failed: "+err.Error())
+	}
+	if _, err = os.Stat(filepath.Join(j.gopath, p, "go.mod")); err == nil {
+		mods, err2 := j.output(p, []string{"go", "list", "-m", "all"})
+		if err2 != nil {
+			errs = append(errs, "go list -m all failed: "+err2.Error())
+		} else {
+			m.Modules = strings.Split(mods, "\n")
+		}
+	}
+	b, err := json.MarshalIndent(&m, "", "  ")
+	if err != nil {
+		return err.Error(), false
+	}
+	out := j.redact(string(b)) + "\n"
+	if len(errs) != 0 {
+		out += "\n" + strings.Join(errs, "\n") + "\n"
+	}
+	return out, len(errs) == 0
+}
+
 // runChecks is the fourth part of a job.
 func (j *jobRequest) runChecks(checks []gohci.Check, results chan<- gistFile) bool {
 	ok := true
 	nb := len(strconv.Itoa(len(checks)))
 	for i, c := range checks {
+		if j.ctx.Err() != nil {
+			// Canceled, do not bother running the remaining checks.
+			return false
+		}
+		name := fmt.Sprintf("cmd%0*d", nb, i+1)
+		if reason := j.skipReason(c.When); reason != "" {
+			results <- gistFile{name: name + " SKIPPED", content: "Skipped: " + reason + "\n  " + strings.Join(c.Cmd, " ") + "\n", success: true, check: i + 1, skipped: true}
+			continue
+		}
 		start := time.Now()
 		d := filepath.Join("src", j.getPath())
 		if c.Dir != "" {
@@ -358,14 +662,136 @@ func (j *jobRequest) runChecks(checks []gohci.Check, results chan<- gistFile) bo
 			// symlinks. That said we can't do miracles without a proper namespace.
 			d = filepath.Join(d, c.Dir)
 		}
-		stdout, ok2 := j.run(d, c.Env, c.Cmd, true)
-		results <- gistFile{fmt.Sprintf("cmd%0*d", nb, i+1), stdout, ok2, time.Since(start)}
+		if isCacheMutating(c.Cmd) {
+			muCache.Lock()
+		} else {
+			muCache.RLock()
+		}
+		stdout, ok2 := j.runCheck(d, c)
+		if isCacheMutating(c.Cmd) {
+			muCache.Unlock()
+		} else {
+			muCache.RUnlock()
+		}
+		results <- gistFile{name: name, content: stdout, success: ok2, d: time.Since(start), check: i + 1}
 		// Still run the other tests.
 		ok = ok && ok2
 	}
 	return ok
 }
 
+// maxArtifactSize is the maximum size of an artifact file. Larger files are
+// not uploaded.
+const maxArtifactSize = 1024 * 1024
+
+// collectArtifacts returns the content of the artifact files of the checks
+// that were run, keyed by gist file name.
+//
+// Only regular files within the checkout are returned. The secrets are
+// redacted from text files. Binary files are base64 encoded and their name is
+// suffixed with ".b64", or skipped when the repository has secrets.
+func (j *jobRequest) collectArtifacts(checks []gohci.Check) map[string]string {
+	root := filepath.Join(j.gopath, "src", j.getPath())
+	out := map[string]string{}
+	for _, c := range checks {
+		if j.skipReason(c.When) != "" {
+			continue
+		}
+		for _, p := range c.Artifacts {
+			matches, err := filepath.Glob(filepath.Join(root, filepath.FromSlash(p)))
+			if err != nil {
+				log.Printf("- invalid artifact pattern %q: %v", p, err)
+				continue
+			}
+			for _, m := range matches {
+				rel, b, err := readArtifact(root, m)
+				if err != nil {
+					log.Printf("- skipping artifact %s: %v", m, err)
+					continue
+				}
+				if rel == "" {
+					continue
+				}
+				if name := artifactName(rel); utf8.Valid(b) && !bytes.ContainsRune(b, 0) {
+					out[name] = j.redact(string(b))
+				} else if len(j.hidden) != 0 {
+					// The secrets can't be reliably redacted from binary content, e.g. a
+					// compressed file.
+					log.Printf("- skipping binary artifact %s since the repository has secrets", rel)
+				} else {
+					out[name+".b64"] = base64.StdEncoding.EncodeToString(b)
+				}
+			}
+		}
+	}
+	return out
+}
+
+// runCheck runs a check from relwd.
+//
+// When j.durations is set, the check is killed if it runs longer than the
+// timeout derived from its historical durations.
+func (j *jobRequest) runCheck(relwd string, c gohci.Check) (string, bool) {
+	if j.durations == nil {
+		return j.run(relwd, c.Env, c.Cmd, true, c.PTY)
+	}
+	key := j.getID() + " " + c.Dir + " " + strings.Join(c.Cmd, " ")
+	ctx := j.ctx
+	t := j.durations.timeout(key)
+	if t > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(j.ctx, t)
+		defer cancel()
+	}
+	start := time.Now()
+	stdout, ok := j.runContext(ctx, relwd, c.Env, c.Cmd, true, c.PTY)
+	if ok {
+		j.durations.add(key, time.Since(start))
+	} else if ctx.Err() == context.DeadlineExceeded && j.ctx.Err() == nil {
+		stdout += fmt.Sprintf("\n<killed after the timeout of %s>\n", roundDuration(t))
+	}
+	return stdout, ok
+}
+
+// skipChecks reports all the checks as skipped.
+func (j *jobRequest) skipChecks(checks []gohci.Check, reason string, results chan<- gistFile) {
+	nb := len(strconv.Itoa(len(checks)))
+	for i, c := range checks {
+		results <- gistFile{name: fmt.Sprintf("cmd%0*d SKIPPED", nb, i+1), content: "Skipped: " + reason + "\n  " + strings.Join(c.Cmd, " ") + "\n", success: true, check: i + 1, skipped: true}
+	}
+}
+
+// skipReason returns why a check with this condition must be skipped, or ""
+// if it must be run.
+func (j *jobRequest) skipReason(c gohci.Condition) string {
+	if c.Tags && !strings.HasPrefix(j.ref, "refs/tags/") {
+		return "not a tag"
+	}
+	branch := ""
+	if strings.HasPrefix(j.ref, "refs/heads/") {
+		branch = j.ref[len("refs/heads/"):]
+	}
+	if c.DefaultBranch && (branch == "" || branch != j.defaultBranch) {
+		return "not on the default branch"
+	}
+	if len(c.Branches) != 0 {
+		found := false
+		for _, b := range c.Branches {
+			if b == branch {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "not on branch " + strings.Join(c.Branches, ", ")
+		}
+	}
+	if len(c.Files) != 0 && j.files != nil && !matchFiles(c.Files, j.files) {
+		return "no changed file matches " + strings.Join(c.Files, ", ")
+	}
+	return ""
+}
+
 // cleanup is both the first and the last part of a job.
 func (j *jobRequest) cleanup(name string, results chan<- gistFile) bool {
 	start := time.Now()
@@ -385,7 +811,95 @@ func (j *jobRequest) cleanup(name string, results chan<- gistFile) bool {
 		}
 	}
 	if out != "" {
-		results <- gistFile{name, out, ok, time.Since(start)}
+		results <- gistFile{name: name, content: out, success: ok, d: time.Since(start)}
 	}
 	return ok
 }
+
+//
+
+// readArtifact returns the path relative to root and the content of the
+// artifact file p.
+//
+// It returns an empty path if p is not a regular file within root.
+func readArtifact(root, p string) (string, []byte, error) {
+	rel, err := filepath.Rel(root, p)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", nil, nil
+	}
+	// Lstat to not follow symlinks outside of the checkout.
+	fi, err := os.Lstat(p)
+	if err != nil || !fi.Mode().IsRegular() {
+		return "", nil, err
+	}
+	if fi.Size() > maxArtifactSize {
+		return "", nil, fmt.Errorf("too large: %s", roundSize(uint64(fi.Size())))
+	}
+	b, err := ioutil.ReadFile(p)
+	return rel, b, err
+}
+
+// artifactName returns the gist file name for an artifact at the relative path
+// rel. Gist file names cannot contain path separators.
+func artifactName(rel string) string {
+	return "artifact-" + strings.Replace(filepath.ToSlash(rel), "/", "_", -1)
+}
+
+// isGo returns true if the executable is the go tool.
+func isGo(exe string) bool {
+	n := filepath.Base(exe)
+	return n == "go" || n == "go.exe"
+}
+
+// isCacheMutating returns true if the command clears one of the Go caches that
+// are shared with concurrent builds.
+func isCacheMutating(cmd []string) bool {
+	if len(cmd) < 2 || cmd[1] != "clean" {
+		return false
+	}
+	if !isGo(cmd[0]) {
+		return false
+	}
+	for _, a := range cmd[2:] {
+		switch strings.TrimLeft(a, "-") {
+		case "cache", "testcache", "modcache", "fuzzcache":
+			return true
+		}
+	}
+	return false
+}
+
+// redactEnv returns a copy of env with the values of the variables with a name
+// that looks sensitive redacted.
+func redactEnv(env []string) []string {
+	out := make([]string, 0, len(env))
+	for _, e := range env {
+		i := strings.IndexByte(e, '=')
+		n := strings.ToUpper(e[:i+1])
+		for _, s := range []string{"TOKEN", "SECRET", "PASSWORD", "KEY", "CREDENTIAL"} {
+			if strings.Contains(n, s) {
+				e = e[:i+1] + "<redacted>"
+				break
+			}
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// matchFiles returns true if any file matches any of the patterns.
+func matchFiles(patterns, files []string) bool {
+	for _, f := range files {
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, f); ok {
+				return true
+			}
+			if !strings.Contains(p, "/") {
+				if ok, _ := path.Match(p, path.Base(f)); ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -5,8 +5,17 @@
 package main
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
+
+	"periph.io/x/gohci"
 )
 
 func TestRoundDuration(t *testing.T) {
@@ -59,3 +68,197 @@ func TestRoundSize(t *testing.T) {
 		}
 	}
 }
+
+func TestIsCacheMutating(t *testing.T) {
+	data := []struct {
+		in       []string
+		expected bool
+	}{
+		{[]string{"go"}, false},
+		{[]string{"go", "test", "./..."}, false},
+		{[]string{"go", "clean", "-i", "./..."}, false},
+		{[]string{"go", "clean", "-cache"}, true},
+		{[]string{"go", "clean", "--testcache"}, true},
+		{[]string{"/usr/local/go/bin/go", "clean", "-modcache"}, true},
+		{[]string{"make", "clean", "-cache"}, false},
+	}
+	for i, l := range data {
+		if v := isCacheMutating(l.in); v != l.expected {
+			t.Fatalf("#%d: isCacheMutating(%v) = %t; not %t", i, l.in, v, l.expected)
+		}
+	}
+}
+
+func TestRedactEnv(t *testing.T) {
+	in := []string{"PATH=/bin", "GITHUB_TOKEN=abc", "api_key=def", "EMPTY=", "SSH_AUTH_SOCK=/tmp/x"}
+	expected := []string{"PATH=/bin", "GITHUB_TOKEN=<redacted>", "api_key=<redacted>", "EMPTY=", "SSH_AUTH_SOCK=/tmp/x"}
+	if out := redactEnv(in); !reflect.DeepEqual(out, expected) {
+		t.Fatalf("unexpected %v", out)
+	}
+}
+
+func TestSkipReason(t *testing.T) {
+	data := []struct {
+		ref      string
+		files    []string
+		c        gohci.Condition
+		expected string
+	}{
+		{"", nil, gohci.Condition{}, ""},
+		{"refs/heads/main", nil, gohci.Condition{DefaultBranch: true}, ""},
+		{"refs/heads/dev", nil, gohci.Condition{DefaultBranch: true}, "not on the default branch"},
+		{"", nil, gohci.Condition{DefaultBranch: true}, "not on the default branch"},
+		{"refs/tags/v1", nil, gohci.Condition{Tags: true}, ""},
+		{"refs/heads/main", nil, gohci.Condition{Tags: true}, "not a tag"},
+		{"refs/heads/dev", nil, gohci.Condition{Branches: []string{"main", "dev"}}, ""},
+		{"refs/heads/foo", nil, gohci.Condition{Branches: []string{"main"}}, "not on branch main"},
+		{"refs/heads/foo", nil, gohci.Condition{Files: []string{"*.go"}}, ""},
+		{"refs/heads/foo", []string{"a/b.go"}, gohci.Condition{Files: []string{"*.go"}}, ""},
+		{"refs/heads/foo", []string{"a/b.go"}, gohci.Condition{Files: []string{"a/*"}}, ""},
+		{"refs/heads/foo", []string{"README.md"}, gohci.Condition{Files: []string{"*.go"}}, "no changed file matches *.go"},
+		{"refs/heads/foo", []string{}, gohci.Condition{Files: []string{"*.go"}}, "no changed file matches *.go"},
+	}
+	for i, l := range data {
+		j := &jobRequest{jobOptions: jobOptions{ref: l.ref, defaultBranch: "main", files: l.files}}
+		if s := j.skipReason(l.c); s != l.expected {
+			t.Fatalf("#%d: skipReason() = %q; not %q", i, s, l.expected)
+		}
+	}
+}
+
+func TestRunFailureWithoutOutput(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires false and sleep")
+	}
+	d, err := ioutil.TempDir("", "gohci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j := &jobRequest{gopath: d, env: os.Environ(), ctx: ctx, cancel: cancel}
+
+	out, ok := j.run("", nil, []string{"false"}, false, false)
+	if ok {
+		t.Fatal("expected failure")
+	}
+	for _, s := range []string{"<failure without output>", "exit:    1\n", "command: false\n", "cwd:     " + d + "\n"} {
+		if !strings.Contains(out, s) {
+			t.Fatalf("missing %q in %q", s, out)
+		}
+	}
+	if strings.Contains(out, "killed") {
+		t.Fatalf("unexpected %q", out)
+	}
+
+	// Timed out.
+	ctx2, cancel2 := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel2()
+	out, ok = j.runContext(ctx2, "", nil, []string{"sleep", "10"}, false, false)
+	if ok || !strings.Contains(out, "killed since it timed out\n") {
+		t.Fatalf("unexpected %t %q", ok, out)
+	}
+
+	// Canceled.
+	cancel()
+	out, ok = j.run("", nil, []string{"sleep", "10"}, false, false)
+	if ok || !strings.Contains(out, "killed since the job was canceled\n") {
+		t.Fatalf("unexpected %t %q", ok, out)
+	}
+}
+
+func TestCacheEnv(t *testing.T) {
+	j := &jobRequest{env: []string{"PATH=/bin", "GIT_SHA=deadbeef", "API_TOKEN=hunter2", "CGO_ENABLED=0"}, hidden: []string{"hunter2"}}
+	expected := []string{
+		"API_TOKEN=sha256:f52fbd32b2b3b86ff88ef6c490628285f482af15ddcb29541f94bcf526a3f6c7",
+		"CGO_ENABLED=0",
+		"PATH=/bin",
+	}
+	if got := j.cacheEnv(); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("unexpected %q", got)
+	}
+}
+
+func TestCollectArtifacts(t *testing.T) {
+	d, err := ioutil.TempDir("", "gohci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	j := &jobRequest{org: "o", repo: "r", gopath: d}
+	root := filepath.Join(d, "src", j.getPath())
+	if err := os.MkdirAll(filepath.Join(root, "out"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for n, c := range map[string]string{"out/a.txt": "token=hunter2\n", "out/b.bin": "\x00\x01"} {
+		if err := ioutil.WriteFile(filepath.Join(root, filepath.FromSlash(n)), []byte(c), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checks := []gohci.Check{{Cmd: []string{"true"}, Artifacts: []string{"out/*"}}}
+	got := j.collectArtifacts(checks)
+	expected := map[string]string{"artifact-out_a.txt": "token=hunter2\n", "artifact-out_b.bin.b64": "AAE="}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("unexpected %q", got)
+	}
+
+	// With secrets, text is redacted and binary files are skipped.
+	j.hidden = []string{"hunter2"}
+	got = j.collectArtifacts(checks)
+	expected = map[string]string{"artifact-out_a.txt": "token=<redacted>\n"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("unexpected %q", got)
+	}
+}
+
+func TestRunPTY(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("pty is not supported")
+	}
+	d, err := ioutil.TempDir("", "gohci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	j := &jobRequest{gopath: d, env: os.Environ(), ctx: context.Background()}
+
+	// The terminal's "\r\n" are converted back to "\n".
+	out, ok := j.run("", nil, []string{"sh", "-c", "test -t 1 && echo tty"}, false, true)
+	if !ok {
+		t.Fatalf("unexpected failure %q", out)
+	}
+	if s := strings.SplitN(out, "\n", 2); len(s) != 2 || !strings.Contains(s[0], "(exit:0 in ") || s[1] != "tty\n" {
+		t.Fatalf("unexpected %q", out)
+	}
+
+	out, ok = j.run("", nil, []string{"sh", "-c", "test -t 1 && exit 3"}, false, true)
+	if ok || !strings.Contains(out, "(exit:3 in ") {
+		t.Fatalf("unexpected %t %q", ok, out)
+	}
+}
+
+func TestRunKillsProcessGroup(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires sh")
+	}
+	d, err := ioutil.TempDir("", "gohci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	j := &jobRequest{gopath: d, env: os.Environ(), ctx: context.Background()}
+	for i, tty := range []bool{false, true} {
+		// sh forks sleep, which inherits the output.
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		start := time.Now()
+		out, ok := j.runContext(ctx, "", nil, []string{"sh", "-c", "sleep 10; echo done"}, false, tty)
+		cancel()
+		if ok || !strings.Contains(out, "killed since it timed out\n") {
+			t.Fatalf("#%d: unexpected %t %q", i, ok, out)
+		}
+		if dur := time.Since(start); dur > 5*time.Second {
+			t.Fatalf("#%d: took %s", i, dur)
+		}
+	}
+}
@@ -30,7 +30,7 @@ import (
 func runLocal(w worker, org, repo, altpath, commitHash string, useSSH bool) error {
 	log.Printf("Running locally")
 	// The reason for using the async version is that it creates the status.
-	w.enqueueCheck(org, repo, altpath, commitHash, useSSH, 0, nil)
+	w.enqueueCheck(org, repo, altpath, commitHash, useSSH, 0, nil, jobOptions{})
 	w.wait()
 	// TODO(maruel): Return any error that occurred.
 	return nil
@@ -74,7 +74,7 @@ func mainImpl() error {
 	if err != nil {
 		return err
 	}
-	w := newWorkerQueue(c.Name, wd, c.Oauth2AccessToken)
+	w := newWorkerQueue(c, wd)
 	if len(*test) != 0 {
 		parts := strings.SplitN(*test, "/", 2)
 		return runLocal(w, parts[0], parts[1], *alt, *commit, *useSSH)
@@ -0,0 +1,84 @@
+// Copyright 2020 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// maxStatusSlots is the maximum number of commits to remember the statuses
+// ordering of.
+const maxStatusSlots = 1000
+
+// statusOrder serializes the statuses posted per commit status context and
+// drops the ones from job requests older than the most recent one that posted
+// for it, e.g. when a push and a PR event trigger builds for the same commit.
+// This way the final status reflects the most recent build.
+//
+// The zero value is ready to use.
+type statusOrder struct {
+	mu    sync.Mutex
+	seq   int64                  // Last sequence number returned by next()
+	keys  []string               // From the least to the most recently added
+	slots map[string]*statusSlot // Keyed by statusKey()
+}
+
+// statusSlot serializes the statuses posted for a commit status context.
+type statusSlot struct {
+	mu  sync.Mutex
+	seq int64 // Sequence number of the most recent job request that posted
+}
+
+// next returns the sequence number of a new job request.
+func (o *statusOrder) next() int64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.seq++
+	return o.seq
+}
+
+// post calls f to post a status for the commit key by the job request with
+// the sequence number seq, unless a more recent job request already posted
+// one.
+//
+// Returns f's result, or true when the status is dropped.
+func (o *statusOrder) post(key string, seq int64, f func() bool) bool {
+	s := o.slot(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if seq < s.seq {
+		log.Printf("- Skipping status for %s, superseded by a more recent build", key)
+		return true
+	}
+	s.seq = seq
+	return f()
+}
+
+// statusKey returns the key of a commit status context in statusOrder.
+func statusKey(org, repo, commitHash, context string) string {
+	return org + "/" + repo + "@" + commitHash + " " + context
+}
+
+// slot returns the slot for the commit key, evicting the oldest ones if
+// necessary.
+func (o *statusOrder) slot(key string) *statusSlot {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if s := o.slots[key]; s != nil {
+		return s
+	}
+	if o.slots == nil {
+		o.slots = map[string]*statusSlot{}
+	}
+	s := &statusSlot{}
+	o.slots[key] = s
+	o.keys = append(o.keys, key)
+	if len(o.keys) > maxStatusSlots {
+		delete(o.slots, o.keys[0])
+		o.keys = o.keys[1:]
+	}
+	return s
+}
@@ -0,0 +1,69 @@
+// Copyright 2020 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestStatusOrder(t *testing.T) {
+	o := statusOrder{}
+	push, pr := o.next(), o.next()
+	var posted []string
+	post := func(key string, seq int64, name string) bool {
+		return o.post(key, seq, func() bool {
+			posted = append(posted, name)
+			return name != "fail"
+		})
+	}
+	if !post("o/r@1", pr, "pr pending") || !post("o/r@1", push, "push pending") || !post("o/r@1", pr, "pr success") {
+		t.Fatal("expected true")
+	}
+	// Another commit is independent.
+	post("o/r@2", push, "push other commit")
+	// The result of f is returned.
+	if post("o/r@3", push, "fail") {
+		t.Fatal("expected false")
+	}
+	expected := []string{"pr pending", "pr success", "push other commit", "fail"}
+	if fmt.Sprint(posted) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected %q", posted)
+	}
+}
+
+func TestStatusOrderSerialized(t *testing.T) {
+	o := statusOrder{}
+	var wg sync.WaitGroup
+	running := 0
+	for i := 0; i < 10; i++ {
+		seq := o.next()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			o.post("o/r@1", seq, func() bool {
+				// Protected by the slot lock.
+				running++
+				if running != 1 {
+					t.Error("concurrent posts")
+				}
+				running--
+				return true
+			})
+		}()
+	}
+	wg.Wait()
+}
+
+func TestStatusOrderEviction(t *testing.T) {
+	o := statusOrder{}
+	for i := 0; i < maxStatusSlots+1; i++ {
+		o.slot(fmt.Sprintf("o/r@%d", i))
+	}
+	if len(o.slots) != maxStatusSlots || len(o.keys) != maxStatusSlots || o.slots["o/r@0"] != nil {
+		t.Fatalf("unexpected %d %d", len(o.slots), len(o.keys))
+	}
+}
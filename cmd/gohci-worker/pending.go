@@ -0,0 +1,184 @@
+// Copyright 2020 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/google/go-github/v31/github"
+)
+
+// pendingReport is the result of a job request that couldn't be posted to
+// GitHub.
+type pendingReport struct {
+	Org               string
+	Repo              string
+	Commit            string
+	GistID            string            // Empty if the gist couldn't be created
+	GistURL           string            // Empty if the gist couldn't be created
+	Description       string            // Gist description
+	Files             map[string]string // Gist files not yet posted
+	State             string            // Commit status state
+	StatusDescription string            // Commit status description
+	Attempts          int               // Number of attempts that failed with a server error
+	Seq               int64             // Sequence number of the job request, see statusOrder
+	Context           string            // Commit status context; the worker name if empty
+}
+
+func newPendingReport(j *jobRequest, gist *github.Gist, status *github.RepoStatus) *pendingReport {
+	r := &pendingReport{
+		Org:               j.org,
+		Repo:              j.repo,
+		Commit:            j.commitHash,
+		GistID:            gist.GetID(),
+		GistURL:           gist.GetHTMLURL(),
+		Description:       gist.GetDescription(),
+		Files:             map[string]string{},
+		State:             status.GetState(),
+		StatusDescription: status.GetDescription(),
+		Seq:               j.seq,
+		Context:           status.GetContext(),
+	}
+	for k, v := range gist.Files {
+		r.Files[string(k)] = v.GetContent()
+	}
+	return r
+}
+
+// maxReportAttempts is the number of server errors after which a report is
+// dropped.
+const maxReportAttempts = 10
+
+// isPermanent returns true if the error returned by GitHub means that retrying
+// the request will not help, e.g. a 404 or a 422.
+func isPermanent(err error) bool {
+	if e, ok := err.(*github.ErrorResponse); ok && e.Response != nil {
+		return e.Response.StatusCode >= 400 && e.Response.StatusCode < 500 && e.Response.StatusCode != 429
+	}
+	return false
+}
+
+// pendingQueue is the queue of reports to post once GitHub is reachable.
+//
+// It is persisted on disk so it survives restarts.
+type pendingQueue struct {
+	path string
+
+	mu      sync.Mutex
+	reports []*pendingReport
+}
+
+// loadPendingQueue loads the queue from path, if present.
+func loadPendingQueue(path string) *pendingQueue {
+	p := &pendingQueue{path: path}
+	if b, err := ioutil.ReadFile(path); err == nil {
+		if err = json.Unmarshal(b, &p.reports); err != nil {
+			log.Printf("Failed to load %s: %v", path, err)
+		} else if len(p.reports) != 0 {
+			log.Printf("Loaded %d pending reports", len(p.reports))
+		}
+	}
+	return p
+}
+
+// add adds a report to the queue.
+func (p *pendingQueue) add(r *pendingReport) {
+	log.Printf("- Queuing report for %s/%s at %s", r.Org, r.Repo, r.Commit)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reports = append(p.reports, r)
+	p.save()
+}
+
+// gistIDs returns the IDs of the gists of the queued reports.
+func (p *pendingQueue) gistIDs() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var out []string
+	for _, r := range p.reports {
+		if r.GistID != "" {
+			out = append(out, r.GistID)
+		}
+	}
+	return out
+}
+
+// process calls post for a copy of each queued report, in order, and removes
+// the ones successfully posted.
+//
+// It stops at the first transient failure, since GitHub is likely still
+// unreachable. A report is dropped when GitHub rejects it, e.g. because the
+// gist or the repository was deleted, or after maxReportAttempts server
+// errors.
+func (p *pendingQueue) process(post func(r *pendingReport) error) {
+	// Post copies of the reports without holding the lock, since the GitHub
+	// calls can take a while and add() must not block meanwhile. It is only
+	// called from retryPending() so there is no concurrent processing.
+	p.mu.Lock()
+	queued := append([]*pendingReport(nil), p.reports...)
+	p.mu.Unlock()
+	if len(queued) == 0 {
+		return
+	}
+	// Updated copy of each processed report, nil when it is to be removed.
+	processed := map[*pendingReport]*pendingReport{}
+	for _, q := range queued {
+		r := &pendingReport{}
+		*r = *q
+		if err := post(r); err != nil {
+			if isPermanent(err) {
+				log.Printf("- Dropping report for %s/%s at %s: %v", r.Org, r.Repo, r.Commit, err)
+			} else if _, ok := err.(*github.ErrorResponse); !ok {
+				// Network error or rate limiting.
+				processed[q] = r
+				break
+			} else {
+				r.Attempts++
+				if r.Attempts < maxReportAttempts {
+					processed[q] = r
+					break
+				}
+				log.Printf("- Dropping report for %s/%s at %s after %d attempts: %v", r.Org, r.Repo, r.Commit, r.Attempts, err)
+			}
+		}
+		processed[q] = nil
+	}
+
+	// Merge back, keeping the reports added meanwhile.
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var reports []*pendingReport
+	for _, r := range p.reports {
+		if u, ok := processed[r]; !ok {
+			reports = append(reports, r)
+		} else if u != nil {
+			reports = append(reports, u)
+		}
+	}
+	p.reports = reports
+	// Always save, since a partially posted report may have been updated.
+	p.save()
+}
+
+// save writes the queue to disk. p.mu must be held.
+func (p *pendingQueue) save() {
+	if len(p.reports) == 0 {
+		if err := os.Remove(p.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove %s: %v", p.path, err)
+		}
+		return
+	}
+	b, err := json.MarshalIndent(p.reports, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(p.path, b, 0600)
+	}
+	if err != nil {
+		log.Printf("Failed to save %s: %v", p.path, err)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2020 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-github/v31/github"
+)
+
+func TestPendingQueue(t *testing.T) {
+	d, err := ioutil.TempDir("", "gohci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	path := filepath.Join(d, "pending.json")
+
+	p := loadPendingQueue(path)
+	p.add(&pendingReport{Commit: "1"})
+	p.add(&pendingReport{Commit: "2"})
+	p.add(&pendingReport{Commit: "3"})
+
+	// Reloading from disk must return the same queue.
+	p = loadPendingQueue(path)
+	if len(p.reports) != 3 {
+		t.Fatalf("unexpected %v", p.reports)
+	}
+	var posted []string
+	p.process(func(r *pendingReport) error {
+		if r.Commit == "1" {
+			// The queue is not locked while posting.
+			p.add(&pendingReport{Commit: "4"})
+		}
+		if r.Commit == "2" {
+			r.GistID = "gist"
+			return errors.New("network error")
+		}
+		posted = append(posted, r.Commit)
+		return nil
+	})
+	if len(posted) != 1 || posted[0] != "1" {
+		t.Fatalf("unexpected %v", posted)
+	}
+	p = loadPendingQueue(path)
+	if len(p.reports) != 3 || p.reports[0].GistID != "gist" || p.reports[2].Commit != "4" {
+		t.Fatalf("unexpected %v", p.reports)
+	}
+	p.process(func(r *pendingReport) error { return nil })
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected file to be deleted: %v", err)
+	}
+}
+
+func TestPendingQueueErrors(t *testing.T) {
+	d, err := ioutil.TempDir("", "gohci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	resp := func(code int) error {
+		return &github.ErrorResponse{Response: &http.Response{StatusCode: code, Request: &http.Request{Method: "POST", URL: &url.URL{}}}}
+	}
+
+	p := loadPendingQueue(filepath.Join(d, "pending.json"))
+	p.add(&pendingReport{Commit: "1"})
+	p.add(&pendingReport{Commit: "2"})
+	p.add(&pendingReport{Commit: "3"})
+	// A rejected report doesn't block the following ones.
+	p.process(func(r *pendingReport) error {
+		if r.Commit == "1" {
+			return resp(404)
+		}
+		if r.Commit == "3" {
+			return resp(502)
+		}
+		return nil
+	})
+	if len(p.reports) != 1 || p.reports[0].Commit != "3" || p.reports[0].Attempts != 1 {
+		t.Fatalf("unexpected %v", p.reports)
+	}
+	// Server errors are retried up to maxReportAttempts.
+	for i := 1; i < maxReportAttempts; i++ {
+		if len(p.reports) != 1 {
+			t.Fatalf("#%d: unexpected %v", i, p.reports)
+		}
+		p.process(func(r *pendingReport) error { return resp(500) })
+	}
+	if len(p.reports) != 0 {
+		t.Fatalf("unexpected %v", p.reports)
+	}
+}
+
+func TestIsPermanent(t *testing.T) {
+	data := []struct {
+		err      error
+		expected bool
+	}{
+		{errors.New("dial tcp: timeout"), false},
+		{&github.ErrorResponse{Response: &http.Response{StatusCode: 404}}, true},
+		{&github.ErrorResponse{Response: &http.Response{StatusCode: 422}}, true},
+		{&github.ErrorResponse{Response: &http.Response{StatusCode: 429}}, false},
+		{&github.ErrorResponse{Response: &http.Response{StatusCode: 503}}, false},
+		{&github.RateLimitError{}, false},
+	}
+	for i, l := range data {
+		if v := isPermanent(l.err); v != l.expected {
+			t.Fatalf("#%d: isPermanent() = %t", i, v)
+		}
+	}
+}
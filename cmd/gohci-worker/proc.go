@@ -0,0 +1,26 @@
+// Copyright 2020 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// +build !windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts the command in its own process group, so it can be
+// killed along its children.
+func setProcessGroup(c *exec.Cmd) {
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup kills the process group of the started command.
+//
+// The command must have been started with setProcessGroup or in its own
+// session.
+func killProcessGroup(c *exec.Cmd) {
+	_ = syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,18 @@
+// Copyright 2020 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup is a no-op on Windows.
+func setProcessGroup(c *exec.Cmd) {
+}
+
+// killProcessGroup only kills the command itself on Windows.
+func killProcessGroup(c *exec.Cmd) {
+	_ = c.Process.Kill()
+}
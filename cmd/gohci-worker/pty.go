@@ -0,0 +1,38 @@
+// Copyright 2020 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os/exec"
+
+	"github.com/creack/pty"
+)
+
+// runPTY runs the command under a pseudo-terminal and returns its merged
+// output.
+//
+// The command runs in its own session, so its process group is killed when
+// ctx is done.
+func runPTY(ctx context.Context, c *exec.Cmd) ([]byte, error) {
+	f, err := pty.Start(c)
+	if err != nil {
+		return nil, err
+	}
+	stop := killOnDone(ctx, c)
+	defer stop()
+	buf := bytes.Buffer{}
+	// The read fails with EIO once the child process exited and closed its end
+	// of the terminal, so the error is ignored.
+	_, _ = io.Copy(&buf, f)
+	err = c.Wait()
+	_ = f.Close()
+	// The terminal converts "\n" to "\r\n".
+	return bytes.Replace(buf.Bytes(), []byte("\r\n"), []byte("\n"), -1), err
+}
@@ -0,0 +1,16 @@
+// Copyright 2020 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+)
+
+// runPTY is not supported on Windows.
+func runPTY(ctx context.Context, c *exec.Cmd) ([]byte, error) {
+	return nil, errors.New("pty is not supported on Windows")
+}
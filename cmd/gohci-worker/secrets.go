@@ -0,0 +1,64 @@
+// Copyright 2020 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// secretProvider fetches the secrets for a build.
+//
+// It is called for each build so rotated secrets are picked up without
+// restarting the worker.
+type secretProvider interface {
+	// secrets returns the secrets as KEY=VALUE environment variables.
+	secrets(ctx context.Context) ([]string, error)
+}
+
+// cmdSecretProvider runs a command that prints the secrets on stdout.
+type cmdSecretProvider struct {
+	cmd  []string
+	repo string
+}
+
+// secrets implements secretProvider.
+func (c *cmdSecretProvider) secrets(ctx context.Context) ([]string, error) {
+	cmd := getCmd(ctx, "", c.cmd)
+	// PATH may be temporarily overridden by a concurrent getCmd().
+	muCmd.Lock()
+	cmd.Env = append(os.Environ(), "GOHCI_REPO="+c.repo)
+	muCmd.Unlock()
+	out, err := cmd.Output()
+	if err != nil {
+		// Do not print stdout, it may contain secrets.
+		return nil, fmt.Errorf("failed to fetch secrets with %s: %v", strings.Join(c.cmd, " "), err)
+	}
+	return parseSecrets(string(out))
+}
+
+// parseSecrets parses KEY=VALUE lines. Empty lines and lines starting with #
+// are ignored.
+func parseSecrets(s string) ([]string, error) {
+	var out []string
+	for i, l := range strings.Split(s, "\n") {
+		l = strings.TrimRight(l, "\r")
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		if strings.IndexByte(l, '=') <= 0 {
+			// Do not print the line, it may contain a secret.
+			return nil, fmt.Errorf("invalid secret on line %d", i+1)
+		}
+		out = append(out, l)
+	}
+	if len(out) == 0 {
+		return nil, errors.New("no secret was returned")
+	}
+	return out, nil
+}
@@ -0,0 +1,37 @@
+// Copyright 2020 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSecrets(t *testing.T) {
+	out, err := parseSecrets("# comment\r\nA=1\r\n\nB=x=y\nC=\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"A=1", "B=x=y", "C="}; !reflect.DeepEqual(out, expected) {
+		t.Fatalf("unexpected %v", out)
+	}
+	for _, s := range []string{"", "# only a comment\n", "A=1\nsecret\n", "=1\n"} {
+		if _, err = parseSecrets(s); err == nil {
+			t.Fatalf("parseSecrets(%q) expected error", s)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	j := &jobRequest{}
+	j.addSecrets([]string{"TOKEN=hunter2", "EMPTY=", "SHORT=1"})
+	if len(j.env) != 3 {
+		t.Fatalf("unexpected %v", j.env)
+	}
+	// Values too short are not redacted, they would mangle the output.
+	if s := j.redact("password 1 is hunter2."); s != "password 1 is <redacted>." {
+		t.Fatal(s)
+	}
+}
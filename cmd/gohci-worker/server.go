@@ -80,7 +80,7 @@ type server struct {
 //
 // While the task is started asynchronously, a synchronous status update is
 // done so the user is immediately alerted that the task is pending on the
-// host. Only one task runs at a time.
+// host. By default, only one task runs at a time.
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Printf("%-4s %-21s %s", r.Method, r.RemoteAddr, r.URL.Path)
 	defer r.Body.Close()
@@ -138,6 +138,8 @@ func (s *server) handleHook(t string, payload []byte, altPath string, superUsers
 	log.Printf("altPath=%s; superUsers=%s", altPath, strings.Join(superUsers, ","))
 	// Process the rest asynchronously so the hook doesn't take too long.
 	switch e := event.(type) {
+	case *github.CreateEvent:
+		s.handleCreate(e, altPath)
 	case *github.CommitCommentEvent:
 		s.handleCommitComment(e, altPath, superUsers)
 	case *github.IssueCommentEvent:
@@ -164,7 +166,28 @@ func (s *server) handleCommitComment(e *github.CommitCommentEvent, altPath strin
 		return
 	}
 	// TODO(maruel): The commit could be on a branch never fetched?
-	s.w.enqueueCheck(*e.Repo.Owner.Login, *e.Repo.Name, altPath, *e.Comment.CommitID, *e.Repo.Private, 0, nil)
+	s.w.enqueueCheck(*e.Repo.Owner.Login, *e.Repo.Name, altPath, *e.Comment.CommitID, *e.Repo.Private, 0, nil, jobOptions{})
+}
+
+// https://developer.github.com/v3/activity/events/types/#createevent
+func (s *server) handleCreate(e *github.CreateEvent, altPath string) {
+	if len(s.c.CreateChecks) == 0 {
+		log.Printf("- ignoring create event")
+		return
+	}
+	var ref string
+	switch *e.RefType {
+	case "branch":
+		ref = "refs/heads/" + *e.Ref
+	case "tag":
+		ref = "refs/tags/" + *e.Ref
+	default:
+		log.Printf("- ignoring create %s event", *e.RefType)
+		return
+	}
+	log.Printf("- Create %s %s", *e.Repo.FullName, ref)
+	// The commit hash is not provided. :(
+	s.w.enqueueCheck(*e.Repo.Owner.Login, *e.Repo.Name, altPath, "", *e.Repo.Private, 0, nil, jobOptions{ref: ref, defaultBranch: e.Repo.GetDefaultBranch(), checks: s.c.CreateChecks, create: true})
 }
 
 // https://developer.github.com/v3/activity/events/types/#issuecommentevent
@@ -191,23 +214,32 @@ func (s *server) handleIssueComment(e *github.IssueCommentEvent, altPath string,
 		return
 	}
 	// The commit hash is not provided. :(
-	s.w.enqueueCheck(*e.Repo.Owner.Login, *e.Repo.Name, altPath, "", *e.Repo.Private, *e.Issue.Number, nil)
+	s.w.enqueueCheck(*e.Repo.Owner.Login, *e.Repo.Name, altPath, "", *e.Repo.Private, *e.Issue.Number, nil, jobOptions{})
 }
 
 // https://developer.github.com/v3/activity/events/types/#pullrequestevent
 func (s *server) handlePullRequest(e *github.PullRequestEvent, altPath string, superUsers []string) {
-	if *e.Action != "opened" && *e.Action != "synchronize" {
+	if *e.Action == "converted_to_draft" && s.c.IgnoreDraftPRs {
+		log.Printf("- PR %s #%d converted to draft", *e.Repo.FullName, *e.PullRequest.Number)
+		s.w.cancel(*e.Repo.Owner.Login, *e.Repo.Name, *e.PullRequest.Number)
+		return
+	}
+	if *e.Action != "opened" && *e.Action != "synchronize" && *e.Action != "ready_for_review" {
 		log.Printf("- ignoring action %q for PR from %q", *e.Action, *e.Sender.Login)
 		return
 	}
 	log.Printf("- PR %s #%d %s %s", *e.Repo.FullName, *e.PullRequest.Number, *e.Sender.Login, *e.Action)
+	if e.PullRequest.GetDraft() && s.c.IgnoreDraftPRs {
+		log.Printf("- ignoring draft PR #%d", *e.PullRequest.Number)
+		return
+	}
 	// TODO(maruel): If a reviewer is set, it has to be set by a repository
 	// owner (?) If so, then it would be safe to run.
 	if !isSuperUser(*e.Sender.Login, superUsers) {
 		log.Printf("- ignoring PR from not super user %q", *e.PullRequest.Head.Repo.FullName)
 		return
 	}
-	s.w.enqueueCheck(*e.Repo.Owner.Login, *e.Repo.Name, altPath, *e.PullRequest.Head.SHA, *e.Repo.Private, *e.PullRequest.Number, nil)
+	s.w.enqueueCheck(*e.Repo.Owner.Login, *e.Repo.Name, altPath, *e.PullRequest.Head.SHA, *e.Repo.Private, *e.PullRequest.Number, nil, jobOptions{})
 }
 
 // https://developer.github.com/v3/activity/events/types/#pullrequestreviewcommentevent
@@ -225,7 +257,7 @@ func (s *server) handlePullRequestReviewComment(e *github.PullRequestReviewComme
 		log.Printf("- ignoring issue #%d comment from user %q", *e.PullRequest.Number, *e.Sender.Login)
 		return
 	}
-	s.w.enqueueCheck(*e.Repo.Owner.Login, *e.Repo.Name, altPath, *e.PullRequest.Head.SHA, *e.Repo.Private, *e.PullRequest.Number, nil)
+	s.w.enqueueCheck(*e.Repo.Owner.Login, *e.Repo.Name, altPath, *e.PullRequest.Head.SHA, *e.Repo.Private, *e.PullRequest.Number, nil, jobOptions{})
 }
 
 // https://developer.github.com/v3/activity/events/types/#pushevent
@@ -251,7 +283,24 @@ func (s *server) handlePush(e *github.PushEvent, altPath string) {
 			blame = []string{author}
 		}
 	}
-	s.w.enqueueCheck(*e.Repo.Owner.Name, *e.Repo.Name, altPath, *e.HeadCommit.ID, *e.Repo.Private, 0, blame)
+	opts := jobOptions{ref: *e.Ref, defaultBranch: e.Repo.GetDefaultBranch()}
+	// GitHub lists at most 20 commits, so the changed files are unknown past
+	// that.
+	if len(e.Commits) != 0 && len(e.Commits) < 20 {
+		opts.files = changedFiles(e.Commits)
+	}
+	s.w.enqueueCheck(*e.Repo.Owner.Name, *e.Repo.Name, altPath, *e.HeadCommit.ID, *e.Repo.Private, 0, blame, opts)
+	if commits := pushCommits(e.Commits, *e.HeadCommit.ID, s.c.MaxPushCommits); len(commits) != 0 {
+		// Each enqueue creates a gist and a status, do not delay the webhook
+		// reply.
+		hashes := make([]string, 0, len(commits))
+		all := make([]jobOptions, 0, len(commits))
+		for _, c := range commits {
+			hashes = append(hashes, c.GetID())
+			all = append(all, jobOptions{ref: *e.Ref, defaultBranch: e.Repo.GetDefaultBranch(), files: changedFiles([]*github.HeadCommit{c})})
+		}
+		s.w.enqueueChecks(*e.Repo.Owner.Name, *e.Repo.Name, altPath, *e.Repo.Private, hashes, all)
+	}
 }
 
 //
@@ -301,6 +350,39 @@ func validateArgs(values url.Values) (string, []string, error) {
 	return altPath, superUsers, nil
 }
 
+// changedFiles returns the files added, modified or removed by the commits.
+func changedFiles(commits []*github.HeadCommit) []string {
+	out := []string{}
+	for _, c := range commits {
+		out = append(out, c.Added...)
+		out = append(out, c.Modified...)
+		out = append(out, c.Removed...)
+	}
+	return out
+}
+
+// pushCommits returns the commits of a push to test in addition to the head
+// commit, so that up to max commits are tested including the head.
+//
+// The commits are ordered from the oldest to the most recent and exclude the
+// head commit. Commits that are not distinct, i.e. already pushed in another
+// branch, are skipped.
+func pushCommits(commits []*github.HeadCommit, head string, max int) []*github.HeadCommit {
+	if max <= 1 {
+		return nil
+	}
+	if len(commits) > max {
+		commits = commits[len(commits)-max:]
+	}
+	var out []*github.HeadCommit
+	for _, c := range commits {
+		if c.GetID() != head && c.GetDistinct() {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
 // isSubset returns true if s is composed of characters from c and is not empty.
 func isSubset(s, allowed string) bool {
 	if s == "" {
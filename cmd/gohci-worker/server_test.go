@@ -0,0 +1,42 @@
+// Copyright 2020 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/go-github/v31/github"
+)
+
+func TestPushCommits(t *testing.T) {
+	c := func(id string, distinct bool) *github.HeadCommit {
+		return &github.HeadCommit{ID: github.String(id), Distinct: github.Bool(distinct)}
+	}
+	commits := []*github.HeadCommit{c("1", true), c("2", false), c("3", true), c("4", true), c("5", true)}
+	data := []struct {
+		max      int
+		expected []string
+	}{
+		{0, nil},
+		{1, nil},
+		// The head is counted in the limit.
+		{2, []string{"4"}},
+		{3, []string{"3", "4"}},
+		// Non distinct commits are skipped.
+		{4, []string{"3", "4"}},
+		{5, []string{"1", "3", "4"}},
+		{20, []string{"1", "3", "4"}},
+	}
+	for i, l := range data {
+		var ids []string
+		for _, x := range pushCommits(commits, "5", l.max) {
+			ids = append(ids, x.GetID())
+		}
+		if !reflect.DeepEqual(ids, l.expected) {
+			t.Fatalf("#%d: pushCommits(%d) = %v; not %v", i, l.max, ids, l.expected)
+		}
+	}
+}
@@ -5,12 +5,19 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
 	"fmt"
 	"log"
+	"net/url"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/go-github/v31/github"
 	"golang.org/x/oauth2"
@@ -22,38 +29,116 @@ type worker interface {
 	// enqueueCheck immediately add the status that the test run is pending and
 	// add the run in the queue. Ensures that the service doesn't restart until
 	// the task is done.
-	enqueueCheck(org, repo, altpath, commitHash string, useSSH bool, pullID int, blame []string)
+	//
+	// If commitHash is empty, it is resolved from the PR or opts.ref, or the
+	// default branch.
+	enqueueCheck(org, repo, altpath, commitHash string, useSSH bool, pullID int, blame []string, opts jobOptions)
+	// enqueueChecks calls enqueueCheck for each commit in the background, so the
+	// caller is not delayed by the creation of the gists and statuses. opts are
+	// the options of each commit.
+	enqueueChecks(org, repo, altpath string, useSSH bool, commitHashes []string, opts []jobOptions)
+	// cancel cancels the enqueued and running job requests for the PR.
+	cancel(org, repo string, pullID int)
 	// wait waits until all enqueued worker job requests are done.
 	wait()
 }
 
 // workerQueue is the task queue server.
 type workerQueue struct {
-	name   string // Copy of config.Name
+	name   string              // Copy of config.Name
+	c      *gohci.WorkerConfig // Worker configuration
 	ctx    context.Context
 	client *github.Client // Used to set commit status and create gists.
 	wd     string
 
-	mu sync.Mutex     // Set when a check is running in runJobRequest()
-	wg sync.WaitGroup // Set for each pending task.
+	sem    chan struct{}  // Limits the number of concurrent runJobRequest()
+	gitSem chan struct{}  // Limits the number of concurrent git network operations, if set
+	wg     sync.WaitGroup // Set for each pending task.
+
+	stopping context.Context    // Canceled by wait() to stop waiting for other CI systems
+	stop     context.CancelFunc // Cancels stopping
+
+	muRepos  sync.Mutex             // Protects repos and checked
+	repos    map[string]*sync.Mutex // Set when a check is running in runJobRequest() for the repo
+	checked  map[string]bool        // Repositories checked for status context collision
+	onceUser sync.Once              // Initializes user
+	user     string                 // Account login of the OAuth2 token
+
+	muJobs sync.Mutex               // Protects jobs and built
+	jobs   map[*jobRequest]struct{} // Enqueued and running job requests
+	built  builtCommits             // Used when config.SupersedePRCommits is set
+
+	order statusOrder // Serializes the statuses per commit
+
+	pending   *pendingQueue    // Set when config.QueueReports is set
+	cache     *resultCache     // Set when config.CacheResults is set
+	durations *durationHistory // Set when config.AdaptiveTimeout.Multiplier is set
 }
 
-func newWorkerQueue(name, wd string, accessToken string) worker {
-	tc := oauth2.NewClient(context.Background(), oauth2.StaticTokenSource(&oauth2.Token{AccessToken: accessToken}))
-	return &workerQueue{
-		name:   name,
-		ctx:    context.Background(),
-		client: github.NewClient(tc),
-		wd:     wd,
+func newWorkerQueue(c *gohci.WorkerConfig, wd string) worker {
+	tc := oauth2.NewClient(context.Background(), oauth2.StaticTokenSource(&oauth2.Token{AccessToken: c.Oauth2AccessToken}))
+	n := c.MaxConcurrentBuilds
+	if n < 1 {
+		n = 1
+	}
+	w := &workerQueue{
+		name:    c.Name,
+		c:       c,
+		ctx:     context.Background(),
+		client:  github.NewClient(tc),
+		wd:      wd,
+		sem:     make(chan struct{}, n),
+		repos:   map[string]*sync.Mutex{},
+		checked: map[string]bool{},
+		jobs:    map[*jobRequest]struct{}{},
+	}
+	w.stopping, w.stop = context.WithCancel(context.Background())
+	// Start from the current time so the sequence numbers keep increasing
+	// across restarts, for the queued reports.
+	w.order.seq = time.Now().UnixNano()
+	if c.MaxGitFetches > 0 {
+		w.gitSem = make(chan struct{}, c.MaxGitFetches)
 	}
+	if c.CacheResults {
+		w.cache = loadResultCache(filepath.Join(wd, "gohci-cache.txt"))
+	}
+	if c.AdaptiveTimeout.Multiplier > 0 {
+		w.durations = loadDurationHistory(filepath.Join(wd, "gohci-durations.json"), c.AdaptiveTimeout)
+	}
+	if c.QueueReports {
+		w.pending = loadPendingQueue(filepath.Join(wd, "gohci-pending.json"))
+		go w.retryPending()
+	}
+	return w
+}
+
+// createContextSuffix is appended to the status context of the checks run on
+// branch or tag creation.
+const createContextSuffix = " (create)"
+
+// enqueueChecks implements worker.
+func (w *workerQueue) enqueueChecks(org, repo, altpath string, useSSH bool, commitHashes []string, opts []jobOptions) {
+	// Count the goroutine so wait() doesn't return before the checks are
+	// enqueued.
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		for i, c := range commitHashes {
+			w.enqueueCheck(org, repo, altpath, c, useSSH, 0, nil, opts[i])
+		}
+	}()
 }
 
 // enqueueCheck implements worker.
-func (w *workerQueue) enqueueCheck(org, repo, altpath, commitHash string, useSSH bool, pullID int, blame []string) {
+func (w *workerQueue) enqueueCheck(org, repo, altpath, commitHash string, useSSH bool, pullID int, blame []string, opts jobOptions) {
 	w.wg.Add(1)
 	defer w.wg.Done()
 
 	j := newJobRequest(org, repo, altpath, commitHash, useSSH, pullID, w.wd)
+	j.jobOptions = opts
+	j.gitSem = w.gitSem
+	j.durations = w.durations
+	j.env = append(j.env, w.c.Repos[j.getID()].Env...)
 	// Immediately fetch the issue head commit inside the webhook, since
 	// it's a race condition.
 	if commitHash == "" && !j.findCommitHash() {
@@ -61,6 +146,7 @@ func (w *workerQueue) enqueueCheck(org, repo, altpath, commitHash string, useSSH
 		return
 	}
 	log.Printf("- Enqueuing test for %s at %s", j.getID(), j.commitHash)
+	j.seq = w.order.next()
 
 	// https://developer.github.com/v3/gists/#create-a-gist
 	gist := &github.Gist{
@@ -71,8 +157,15 @@ func (w *workerQueue) enqueueCheck(org, repo, altpath, commitHash string, useSSH
 			"setup-0-metadata": {Content: github.String(j.metadata())},
 		},
 	}
-	gist, _, err := w.client.Gists.Create(w.ctx, gist)
-	if err != nil {
+	if created, _, err := w.client.Gists.Create(w.ctx, gist); err == nil {
+		gist = created
+		j.gistID = gist.GetID()
+		log.Printf("- Gist at %s", *gist.HTMLURL)
+	} else if w.pending != nil {
+		// Run the tests anyway, the results will be posted once GitHub is
+		// reachable.
+		log.Printf("- Failed to create gist, queuing the report: %v", err)
+	} else {
 		// Don't bother running the tests. We could try setting a status but if the
 		// account can't create the gist, it is possible it can't create the
 		// status too. Need to look at the possibl failure modes and decide which
@@ -80,31 +173,88 @@ func (w *workerQueue) enqueueCheck(org, repo, altpath, commitHash string, useSSH
 		log.Printf("- Failed to create gist: %v", err)
 		return
 	}
-	log.Printf("- Gist at %s", *gist.HTMLURL)
 	// https://developer.github.com/v3/repos/statuses/#create-a-status
+	name := w.name
+	if opts.create {
+		// The push event for the same commit is tested with the full checks, do
+		// not overwrite its status.
+		name += createContextSuffix
+	}
 	status := &github.RepoStatus{
 		State:       github.String("pending"),
 		Description: github.String("Checks pending"),
-		Context:     &w.name,
+		Context:     &name,
 		// Link the gist right away, so users can click and refresh.
 		TargetURL: gist.HTMLURL,
 	}
-	if !w.status(j, status) {
+	if !w.status(j, status) && w.pending == nil {
 		// Don't bother running the tests.
 		return
 	}
 	// Enqueue and run.
 	// TODO(maruel): It should be a buffered channel so it stays FIFO and can
 	// deny when there's too many tasks enqueued.
+	var stale map[string]*github.RepoStatus
+	w.muJobs.Lock()
+	if pullID != 0 && w.c.SupersedePRCommits {
+		stale = w.supersede(j)
+	}
+	w.jobs[j] = struct{}{}
+	w.muJobs.Unlock()
+	for h, s := range stale {
+		// The commit is not part of the PR anymore, so its status will not be
+		// looked at but for the sake of clarity, mark it as superseded.
+		old := *j
+		old.commitHash = h
+		s.State = github.String("error")
+		s.Description = github.String("Superseded by " + j.commitHash[:12])
+		w.status(&old, s)
+	}
 	w.wg.Add(1)
 	go func() {
 		defer w.wg.Done()
 		w.runJobRequest(j, gist, status, blame)
+		if w.c.MaxGistsPerRepo > 0 {
+			w.rotateGists(j)
+		}
 	}()
 }
 
+// cancel implements worker.
+func (w *workerQueue) cancel(org, repo string, pullID int) {
+	w.muJobs.Lock()
+	defer w.muJobs.Unlock()
+	for j := range w.jobs {
+		if j.org == org && j.repo == repo && j.pullID == pullID {
+			log.Printf("- Canceling %s", j)
+			j.cancel()
+		}
+	}
+}
+
+// supersede cancels the job requests for previous commits of the same PR.
+//
+// It returns the last status of the previous commits that were already built
+// for this PR.
+//
+// w.muJobs must be held.
+func (w *workerQueue) supersede(j *jobRequest) map[string]*github.RepoStatus {
+	for old := range w.jobs {
+		if old.org == j.org && old.repo == j.repo && old.pullID == j.pullID && old.commitHash != j.commitHash {
+			log.Printf("- Superseding %s", old)
+			old.cancelDesc = "Superseded by " + j.commitHash[:12]
+			old.cancel()
+		}
+	}
+	stale := w.built.pop(fmt.Sprintf("%s#%d", j.getID(), j.pullID))
+	delete(stale, j.commitHash)
+	return stale
+}
+
 // wait implements worker.
 func (w *workerQueue) wait() {
+	// Do not delay the shutdown for the other CI systems, see shouldNotify().
+	w.stop()
 	w.wg.Wait()
 }
 
@@ -116,11 +266,53 @@ func (w *workerQueue) wait() {
 //
 // TODO(maruel): If "blame" is not empty, an issue is created on failure.
 func (w *workerQueue) runJobRequest(j *jobRequest, gist *github.Gist, status *github.RepoStatus, blame []string) {
-	w.mu.Lock()
-	defer w.mu.Unlock()
+	// Builds for the same repository share the same GOPATH, so only one can run
+	// at a time.
+	mu := w.repoLock(j.getID())
+	mu.Lock()
+	defer mu.Unlock()
+	w.sem <- struct{}{}
+	defer func() {
+		<-w.sem
+	}()
+	defer func() {
+		w.muJobs.Lock()
+		delete(w.jobs, j)
+		w.muJobs.Unlock()
+		j.cancel()
+	}()
 
+	if j.ctx.Err() != nil {
+		log.Printf("- Canceled before running %s", j)
+		w.canceled(j, status)
+		return
+	}
 	log.Printf("- Running test for %s at %s", j.getID(), j.commitHash)
-	failed := w.runJobRequestInner(j, gist, status)
+	failed, synced := w.runJobRequestInner(j, gist, status)
+	if j.ctx.Err() != nil {
+		// The failures are due to the cancellation, do not notify.
+		w.canceled(j, status)
+		return
+	}
+	if !synced && w.pending != nil {
+		w.pending.add(newPendingReport(j, gist, status))
+	}
+	if j.pullID != 0 && w.c.SupersedePRCommits {
+		// Remember it, in case the PR is force-pushed.
+		s := *status
+		w.muJobs.Lock()
+		w.built.add(fmt.Sprintf("%s#%d", j.getID(), j.pullID), j.commitHash, &s)
+		w.muJobs.Unlock()
+	}
+	if w.c.DetectStatusCollision {
+		w.muRepos.Lock()
+		first := !w.checked[j.getID()]
+		w.checked[j.getID()] = true
+		w.muRepos.Unlock()
+		if first {
+			w.detectCollision(j)
+		}
+	}
 
 	// This requires OAuth scope 'public_repo' or 'repo'. The problem is that
 	// this gives full write access, not just issue creation and this is
@@ -128,29 +320,60 @@ func (w *workerQueue) runJobRequest(j *jobRequest, gist *github.Gist, status *gi
 	// code there as this is harmless and still work is people do not care about
 	// security.
 	if failed && len(blame) != 0 {
-		title := fmt.Sprintf("Build %q failed on %s", w.name, j.commitHash)
-		log.Printf("- Failed: %s", title)
-		log.Printf("- Blame: %v", blame)
-		// createIssue(j, gist, blame, title)
+		// shouldNotify may wait for the other CI systems, do not hold the
+		// repository lock and the build slot meanwhile.
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			if w.shouldNotify(j) {
+				title := fmt.Sprintf("Build %q failed on %s", w.name, j.commitHash)
+				log.Printf("- Failed: %s", title)
+				log.Printf("- Blame: %v", blame)
+				// createIssue(j, gist, blame, title)
+			}
+		}()
 	}
 	log.Printf("- testing done: https://github.com/%s/commit/%s", j.getID(), j.commitHash[:12])
 }
 
+// secretProvider returns the secret provider for the repository, if any.
+func (w *workerQueue) secretProvider(j *jobRequest) secretProvider {
+	if cmd := w.c.Repos[j.getID()].SecretsCmd; len(cmd) != 0 {
+		return &cmdSecretProvider{cmd: cmd, repo: j.getID()}
+	}
+	return nil
+}
+
+// repoLock returns the lock for the repository.
+func (w *workerQueue) repoLock(id string) *sync.Mutex {
+	w.muRepos.Lock()
+	defer w.muRepos.Unlock()
+	mu := w.repos[id]
+	if mu == nil {
+		mu = &sync.Mutex{}
+		w.repos[id] = mu
+	}
+	return mu
+}
+
 // runJobRequestInner is the inner loop of runJobRequest. It updates gist as the
 // checks are progressing.
 //
-// Returns true if it failed.
-func (w *workerQueue) runJobRequestInner(j *jobRequest, gist *github.Gist, status *github.RepoStatus) bool {
+// Returns true if it failed, and whether the last gist and status updates
+// succeeded.
+func (w *workerQueue) runJobRequestInner(j *jobRequest, gist *github.Gist, status *github.RepoStatus) (bool, bool) {
 	// The function exits once results is closed by the goroutine below.
 	w.wg.Add(1)
 	defer w.wg.Done()
 	start1 := time.Now()
 	results := make(chan gistFile, 16)
 	type up struct {
-		checks int
+		checks []string
 		gist   gistFile
 	}
 	cc := make(chan up)
+	// Set by the goroutine below before closing results.
+	var artifacts map[string]string
 	go func() {
 		defer close(results)
 
@@ -163,7 +386,7 @@ func (w *workerQueue) runJobRequestInner(j *jobRequest, gist *github.Gist, statu
 		// Phase 1: clone.
 		start2 := time.Now()
 		content, ok := j.checkout()
-		results <- gistFile{"setup-1-clone", content, ok, time.Since(start2)}
+		results <- gistFile{name: "setup-1-clone", content: content, success: ok, d: time.Since(start2)}
 		if !ok {
 			// Still run cleanup.
 			j.cleanup("setup-3-post-cleanup", results)
@@ -171,51 +394,110 @@ func (w *workerQueue) runJobRequestInner(j *jobRequest, gist *github.Gist, statu
 		}
 
 		// Phase 2: parse config.
-		chks, note := j.parseConfig(w.name)
+		chks, note := j.checks, "Using the worker's checks for the event"
+		if len(chks) == 0 {
+			chks, note = j.parseConfig(w.name, w.c.Repos[j.getID()].Checks)
+		}
+		if len(w.c.GoTestFlags) != 0 {
+			chks = addGoTestFlags(chks, w.c.GoTestFlags)
+		}
 		// TODO(maruel): Validate!
 		// Use a different channel to send this update to send also the number of
 		// checks.
+		names := make([]string, len(chks))
+		for i := range chks {
+			names[i] = checkName(chks[i])
+		}
 		cc <- up{
-			checks: len(chks),
-			gist:   gistFile{"setup-2-checks", note + "\nCommands to be run:\n" + cmds(chks), true, 0},
+			checks: names,
+			gist:   gistFile{name: "setup-2-checks", content: note + "\nCommands to be run:\n" + cmds(chks), success: true},
 		}
 
 		// Phase 3: checks.
-		j.runChecks(chks, results)
+		if p := w.secretProvider(j); p != nil {
+			start3 := time.Now()
+			secrets, err := p.secrets(j.ctx)
+			if err != nil {
+				results <- gistFile{name: "setup-2-secrets", content: err.Error(), d: time.Since(start3)}
+				j.cleanup("setup-3-post-cleanup", results)
+				return
+			}
+			j.addSecrets(secrets)
+			results <- gistFile{name: "setup-2-secrets", content: fmt.Sprintf("Fetched %d secrets", len(secrets)), success: true, d: time.Since(start3)}
+		}
+		if w.c.ReproManifest {
+			start3 := time.Now()
+			content, ok = j.manifest(chks)
+			results <- gistFile{name: "setup-2-manifest", content: content, success: ok, d: time.Since(start3)}
+		}
+		key := ""
+		if w.cache != nil {
+			var err error
+			if key, err = j.cacheKey(chks); err != nil {
+				log.Printf("- failed to calculate the cache key: %v", err)
+			}
+		}
+		if key != "" && w.cache.has(key) {
+			// The artifacts are not collected since the checks that generate them
+			// are not run.
+			j.skipChecks(chks, "already succeeded with the same tree, toolchain and checks", results)
+		} else {
+			if j.runChecks(chks, results) && key != "" && j.ctx.Err() == nil {
+				w.cache.add(key)
+			}
+			artifacts = j.collectArtifacts(chks)
+		}
 
 		// Phase 4: cleanup.
 		j.cleanup("setup-3-post-cleanup", results)
 	}()
 
-	// The check #0 is setup-3-checks.
+	// Number of checks done. Only the checks results count, not the setup
+	// steps, so the status doesn't turn successful before the last check ran.
 	checkNum := 0
 	failed := 0
 	total := 0
+	// ranNames are the checks that succeeded, excluding the skipped ones.
+	var names, ranNames, failedNames []string
 	status.Description = github.String("Setting up")
 	w.status(j, status)
 	// Keep a backup of the gist description, will be reused.
 	gistDesc := *gist.Description
+	synced := true
+	flush := func() {
+		ok := w.gist(gist)
+		synced = w.status(j, status) && ok
+	}
 	var delay <-chan time.Time
 	for {
 		select {
 		case <-delay:
-			w.gist(gist)
-			w.status(j, status)
+			flush()
 			delay = nil
 
 		case c := <-cc:
 			// Similar to results but includes updating total.
-			total = c.checks
+			names = c.checks
+			total = len(names)
 			results <- c.gist
 
 		case r, ok := <-results:
 			if !ok {
 				// The channel closed. Do one last update if necessary then quit.
-				if delay != nil {
-					w.gist(gist)
-					w.status(j, status)
+				for n, c := range artifacts {
+					content := c
+					if len(content) == 0 {
+						content = "<empty>"
+					}
+					gist.Files[github.GistFilename(n)] = github.GistFile{Content: &content}
+				}
+				if delay != nil || len(artifacts) != 0 {
+					flush()
+				}
+				if len(artifacts) != 0 && w.c.CommentArtifacts && j.pullID != 0 && gist.ID != nil {
+					w.commentArtifacts(j, gist)
 				}
-				return failed != 0
+				return failed != 0, synced
 			}
 			// https://developer.github.com/v3/gists/#edit-a-gist
 			if len(r.content) == 0 {
@@ -230,46 +512,44 @@ func (w *workerQueue) runJobRequestInner(j *jobRequest, gist *github.Gist, statu
 					firstFailure = true
 				}
 				failed++
+				if r.check > 0 && r.check <= len(names) {
+					failedNames = append(failedNames, names[r.check-1])
+				}
+			} else if r.check > 0 && r.check <= len(names) && !r.skipped {
+				ranNames = append(ranNames, names[r.check-1])
 			}
 			r.name += " in " + roundDuration(r.d).String()
-			gist.Files[github.GistFilename(r.name)] = github.GistFile{Content: &r.content}
+			if t := w.c.GistCompressThreshold; t > 0 && len(r.content) > t {
+				for n, c := range compressGistFile(r.name, r.content) {
+					content := c
+					gist.Files[github.GistFilename(n)] = github.GistFile{Content: &content}
+				}
+			} else {
+				gist.Files[github.GistFilename(r.name)] = github.GistFile{Content: &r.content}
+			}
 
+			if r.check > checkNum {
+				checkNum = r.check
+			}
 			// Update status and gist description. The suffix is used for both.
-			suffix := ""
-			statusDesc := "Setting up"
-			if total != 0 {
-				if checkNum != total {
-					// github already prepends the status with "Pending -".
-					statusDesc = "Running"
-					if failed != 0 {
-						suffix = " FAILED"
-					}
-					suffix += fmt.Sprintf(" (%d/%d)", checkNum, total)
-					checkNum++
+			statusDesc, suffix, done := progress(checkNum, total, failed)
+			var list []string
+			if done {
+				if failed == 0 {
+					status.State = github.String("success")
+					list = ranNames
 				} else {
-					// Last check.
-					if failed == 0 {
-						statusDesc = "Success"
-						suffix = fmt.Sprintf(" (%d/%d)", total, total)
-						status.State = github.String("success")
-					} else {
-						statusDesc = "FAILED"
-						suffix = fmt.Sprintf(" %d out of %d", failed, total)
-					}
+					list = failedNames
 				}
-			} else if failed != 0 {
-				// Still setting up, yet failed.
-				suffix += " FAILED"
 			}
 			// Always add duration up to now.
 			suffix += " in " + roundDuration(time.Since(start1)).String()
 			gist.Description = github.String(gistDesc + suffix)
-			status.Description = github.String(statusDesc + suffix)
+			status.Description = github.String(statusDescription(statusDesc+suffix, list))
 
 			// On first failure, do not wait.
 			if firstFailure {
-				w.gist(gist)
-				w.status(j, status)
+				flush()
 				delay = nil
 			} else if delay == nil {
 				// Otherwise, buffer for one second to reduce the number of RPCs. No
@@ -281,24 +561,237 @@ func (w *workerQueue) runJobRequestInner(j *jobRequest, gist *github.Gist, statu
 	}
 }
 
+// maxBuiltPRs is the maximum number of PRs to remember the built commits of.
+const maxBuiltPRs = 100
+
+// builtCommits remembers the last status of the commits built for the most
+// recently built PRs, so the PRs closed or merged are eventually forgotten.
+//
+// The zero value is ready to use.
+type builtCommits struct {
+	prs []string                                 // From the least to the most recently built
+	m   map[string]map[string]*github.RepoStatus // Keyed by PR, then commit
+}
+
+// add remembers the status of the commit built for the PR.
+func (b *builtCommits) add(pr, commit string, s *github.RepoStatus) {
+	if b.m == nil {
+		b.m = map[string]map[string]*github.RepoStatus{}
+	}
+	if b.m[pr] == nil {
+		b.m[pr] = map[string]*github.RepoStatus{}
+	} else {
+		b.remove(pr)
+	}
+	b.prs = append(b.prs, pr)
+	b.m[pr][commit] = s
+	if len(b.prs) > maxBuiltPRs {
+		delete(b.m, b.prs[0])
+		b.prs = b.prs[1:]
+	}
+}
+
+// pop returns and forgets the statuses of the commits built for the PR.
+func (b *builtCommits) pop(pr string) map[string]*github.RepoStatus {
+	s := b.m[pr]
+	if s != nil {
+		delete(b.m, pr)
+		b.remove(pr)
+	}
+	return s
+}
+
+// remove removes pr from b.prs.
+func (b *builtCommits) remove(pr string) {
+	for i, p := range b.prs {
+		if p == pr {
+			b.prs = append(b.prs[:i], b.prs[i+1:]...)
+			return
+		}
+	}
+}
+
 // status calls into w.client.Repositories.CreateStatus().
+//
+// The statuses are posted via w.order, so the status is silently dropped when a
+// more recent job request already posted a status for the same commit.
 func (w *workerQueue) status(j *jobRequest, status *github.RepoStatus) bool {
-	if _, _, err := w.client.Repositories.CreateStatus(w.ctx, j.org, j.repo, j.commitHash, status); err != nil {
-		if status.ID != nil {
-			log.Printf("- failed to update status: %v", err)
+	return w.order.post(statusKey(j.org, j.repo, j.commitHash, status.GetContext()), j.seq, func() bool {
+		if _, _, err := w.client.Repositories.CreateStatus(w.ctx, j.org, j.repo, j.commitHash, status); err != nil {
+			if status.ID != nil {
+				log.Printf("- failed to update status: %v", err)
+			} else {
+				log.Printf("- Failed to create status: %v", err)
+			}
+			return false
+		}
+		return true
+	})
+}
+
+// canceled updates the status to tell the job request was canceled.
+func (w *workerQueue) canceled(j *jobRequest, status *github.RepoStatus) {
+	status.State = github.String("error")
+	status.Description = github.String("Canceled")
+	if j.cancelDesc != "" {
+		status.Description = github.String(j.cancelDesc)
+	}
+	w.status(j, status)
+}
+
+// retryPending periodically tries to post the queued reports.
+func (w *workerQueue) retryPending() {
+	for range time.Tick(time.Minute) {
+		w.pending.process(w.postReport)
+	}
+}
+
+// postReport posts a report that was queued because GitHub was unreachable.
+//
+// It creates the gist if it wasn't created yet, then updates the status.
+func (w *workerQueue) postReport(r *pendingReport) error {
+	files := map[github.GistFilename]github.GistFile{}
+	for k, v := range r.Files {
+		files[github.GistFilename(k)] = github.GistFile{Content: github.String(v)}
+	}
+	gist := &github.Gist{
+		Description: github.String(r.Description),
+		Public:      github.Bool(false),
+		Files:       files,
+	}
+	if r.GistID == "" {
+		created, _, err := w.client.Gists.Create(w.ctx, gist)
+		if err != nil {
+			log.Printf("- Failed to create queued gist: %v", err)
+			return err
+		}
+		// Do not create it again if the status fails below.
+		r.GistID = created.GetID()
+		r.GistURL = created.GetHTMLURL()
+		r.Files = nil
+	} else if len(r.Files) != 0 {
+		if _, _, err := w.client.Gists.Edit(w.ctx, r.GistID, gist); err != nil {
+			log.Printf("- failed to update queued gist: %v", err)
+			return err
+		}
+		r.Files = nil
+	}
+	status := &github.RepoStatus{
+		State:       github.String(r.State),
+		Description: github.String(r.StatusDescription),
+		Context:     &w.name,
+	}
+	if r.Context != "" {
+		status.Context = github.String(r.Context)
+	}
+	if r.GistURL != "" {
+		status.TargetURL = github.String(r.GistURL)
+	}
+	// A more recent build may have posted a status for the commit meanwhile.
+	var err error
+	w.order.post(statusKey(r.Org, r.Repo, r.Commit, status.GetContext()), r.Seq, func() bool {
+		_, _, err = w.client.Repositories.CreateStatus(w.ctx, r.Org, r.Repo, r.Commit, status)
+		return err == nil
+	})
+	if err != nil {
+		log.Printf("- failed to post queued status: %v", err)
+		return err
+	}
+	log.Printf("- Posted queued report for %s/%s at %s", r.Org, r.Repo, r.Commit)
+	return nil
+}
+
+// detectCollision logs a warning if statuses with this worker's context on the
+// commit were posted by another account or do not link to a gist.
+func (w *workerQueue) detectCollision(j *jobRequest) {
+	w.onceUser.Do(func() {
+		if u, _, err := w.client.Users.Get(w.ctx, ""); err != nil {
+			log.Printf("- failed to get the current user: %v", err)
 		} else {
-			log.Printf("- Failed to create status: %v", err)
+			w.user = u.GetLogin()
+		}
+	})
+	statuses, _, err := w.client.Repositories.ListStatuses(w.ctx, j.org, j.repo, j.commitHash, &github.ListOptions{PerPage: 100})
+	if err != nil {
+		log.Printf("- failed to list statuses: %v", err)
+		return
+	}
+	for _, s := range statuses {
+		if s.GetContext() != w.name {
+			continue
+		}
+		creator := s.GetCreator().GetLogin()
+		host := ""
+		if u, _ := url.Parse(s.GetTargetURL()); u != nil {
+			host = u.Host
+		}
+		if (w.user != "" && creator != w.user) || (host != "" && host != "gist.github.com") {
+			log.Printf("WARNING: ***********************************************************")
+			log.Printf("WARNING: Status context %q on %s is also used by %q linking to %q.", w.name, j, creator, s.GetTargetURL())
+			log.Printf("WARNING: Another worker is likely configured with the same name.")
+			log.Printf("WARNING: ***********************************************************")
+			return
+		}
+	}
+}
+
+// combinedStatusWait is the maximum time to wait for the other statuses to
+// complete when CombinedStatus is "wait". The wait is interrupted by wait().
+const combinedStatusWait = 10 * time.Minute
+
+// combinedStatusPoll is the interval to poll the other statuses when
+// CombinedStatus is "wait".
+const combinedStatusPoll = 30 * time.Second
+
+// shouldNotify returns true if a failure should be notified, taking into
+// account the statuses posted by other CI systems on the same commit as
+// configured with CombinedStatus.
+func (w *workerQueue) shouldNotify(j *jobRequest) bool {
+	if w.c.CombinedStatus == "" {
+		return true
+	}
+	state := w.othersState(j)
+	if w.c.CombinedStatus == "wait" {
+		end := time.Now().Add(combinedStatusWait)
+		for state == "pending" && time.Now().Before(end) {
+			select {
+			case <-time.After(combinedStatusPoll):
+			case <-w.stopping.Done():
+				log.Printf("- Not waiting for the other statuses; shutting down")
+				return true
+			}
+			state = w.othersState(j)
 		}
+	}
+	if state == "success" {
+		log.Printf("- Not notifying failure; other statuses are successful")
 		return false
 	}
 	return true
 }
 
+// othersState calls into w.client.Repositories.GetCombinedStatus() and returns
+// the state of the statuses posted by other contexts than this worker.
+//
+// Returns "" if there is none or on failure.
+func (w *workerQueue) othersState(j *jobRequest) string {
+	cs, _, err := w.client.Repositories.GetCombinedStatus(w.ctx, j.org, j.repo, j.commitHash, &github.ListOptions{PerPage: 100})
+	if err != nil {
+		log.Printf("- failed to get combined status: %v", err)
+		return ""
+	}
+	return combineStates(cs.Statuses, w.name, w.name+createContextSuffix)
+}
+
 // gist calls into w.client.Gists.Edit().
 //
 // It clears the file mapping to reduce I/O, since files are automatically
-// carried over.
+// carried over. The files are kept on failure or when the gist couldn't be
+// created.
 func (w *workerQueue) gist(gist *github.Gist) bool {
+	if gist.ID == nil {
+		return false
+	}
 	if _, _, err := w.client.Gists.Edit(w.ctx, *gist.ID, gist); err != nil {
 		log.Printf("- failed to update gist: %v", err)
 		return false
@@ -307,8 +800,241 @@ func (w *workerQueue) gist(gist *github.Gist) bool {
 	return true
 }
 
+// commentArtifacts creates or updates the comment on the PR linking to the
+// artifacts uploaded to the gist.
+//
+// The comment is found via a marker that includes the worker name.
+func (w *workerQueue) commentArtifacts(j *jobRequest, gist *github.Gist) {
+	// The raw URLs are only known once the files are in the gist.
+	g, _, err := w.client.Gists.Get(w.ctx, gist.GetID())
+	if err != nil {
+		log.Printf("- failed to get gist: %v", err)
+		return
+	}
+	links := map[string]string{}
+	for n, f := range g.Files {
+		if strings.HasPrefix(string(n), "artifact-") {
+			links[string(n)] = f.GetRawURL()
+		}
+	}
+	marker := fmt.Sprintf("<!-- gohci artifacts %s -->", w.name)
+	body := artifactsComment(marker, fmt.Sprintf("Artifacts from %s for %s", w.name, j.commitHash), links)
+	opts := &github.IssueListCommentsOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		comments, resp, err := w.client.Issues.ListComments(w.ctx, j.org, j.repo, j.pullID, opts)
+		if err != nil {
+			log.Printf("- failed to list comments: %v", err)
+			return
+		}
+		for _, c := range comments {
+			if strings.HasPrefix(c.GetBody(), marker) {
+				if _, _, err := w.client.Issues.EditComment(w.ctx, j.org, j.repo, c.GetID(), &github.IssueComment{Body: &body}); err != nil {
+					log.Printf("- failed to edit comment: %v", err)
+				}
+				return
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	if _, _, err := w.client.Issues.CreateComment(w.ctx, j.org, j.repo, j.pullID, &github.IssueComment{Body: &body}); err != nil {
+		log.Printf("- failed to create comment: %v", err)
+	}
+}
+
+// rotateGists deletes the oldest gists created by this worker for the
+// repository beyond MaxGistsPerRepo.
+//
+// Gists are matched by their description. The gists of the job requests
+// enqueued or running and of the pending reports are kept, since they are
+// still to be updated.
+func (w *workerQueue) rotateGists(j *jobRequest) {
+	var all []*github.Gist
+	opts := &github.GistListOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		gists, resp, err := w.client.Gists.List(w.ctx, "", opts)
+		if err != nil {
+			log.Printf("- failed to list gists: %v", err)
+			return
+		}
+		all = append(all, gists...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	keep := map[string]bool{}
+	w.muJobs.Lock()
+	for o := range w.jobs {
+		keep[o.gistID] = true
+	}
+	w.muJobs.Unlock()
+	if w.pending != nil {
+		for _, id := range w.pending.gistIDs() {
+			keep[id] = true
+		}
+	}
+	prefix := fmt.Sprintf("%s for https://github.com/%s/", w.name, j.getID())
+	for _, g := range gistsToDelete(all, prefix, w.c.MaxGistsPerRepo, keep) {
+		log.Printf("- Deleting gist %s", g.GetHTMLURL())
+		if _, err := w.client.Gists.Delete(w.ctx, g.GetID()); err != nil {
+			log.Printf("- failed to delete gist: %v", err)
+		}
+	}
+}
+
 //
 
+// gistsToDelete returns the gists with a description starting with prefix
+// that are older than the max most recent ones, except the ones in keep.
+func gistsToDelete(gists []*github.Gist, prefix string, max int, keep map[string]bool) []*github.Gist {
+	var m []*github.Gist
+	for _, g := range gists {
+		if strings.HasPrefix(g.GetDescription(), prefix) {
+			m = append(m, g)
+		}
+	}
+	if len(m) <= max {
+		return nil
+	}
+	sort.Slice(m, func(i, j int) bool {
+		return m[i].GetCreatedAt().After(m[j].GetCreatedAt())
+	})
+	var out []*github.Gist
+	for _, g := range m[max:] {
+		if !keep[g.GetID()] {
+			out = append(out, g)
+		}
+	}
+	return out
+}
+
+// artifactsComment returns the body of the PR comment linking to the
+// artifacts. Binary artifacts are base64 encoded.
+func artifactsComment(marker, title string, links map[string]string) string {
+	names := make([]string, 0, len(links))
+	for n := range links {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	out := marker + "\n### " + title + "\n\n"
+	for _, n := range names {
+		out += fmt.Sprintf("- [%s](%s)", strings.TrimPrefix(n, "artifact-"), links[n])
+		if strings.HasSuffix(n, ".b64") {
+			out += " (decode with `base64 -d`)"
+		}
+		out += "\n"
+	}
+	return out
+}
+
+// compressGistFile returns the gist files to store content compressed: a
+// summary named name and the gzip compressed base64 encoded content.
+func compressGistFile(name, content string) map[string]string {
+	var b bytes.Buffer
+	// gzip.Writer writing to a bytes.Buffer cannot fail.
+	gz := gzip.NewWriter(&b)
+	_, _ = gz.Write([]byte(content))
+	_ = gz.Close()
+	compressed := name + ".gz.b64"
+	lines := strings.Split(strings.TrimRight(content, "\n"), "\n")
+	summary := fmt.Sprintf("<%s of output, compressed to %s in %q>\nTo decompress, download it then run:\n  base64 -d < %q | gunzip\n\n", roundSize(uint64(len(content))), roundSize(uint64(b.Len())), compressed, compressed)
+	const head, tail = 10, 30
+	if len(lines) <= head+tail {
+		summary += strings.Join(lines, "\n") + "\n"
+	} else {
+		summary += strings.Join(lines[:head], "\n") + fmt.Sprintf("\n<... %d lines ...>\n", len(lines)-head-tail) + strings.Join(lines[len(lines)-tail:], "\n") + "\n"
+	}
+	return map[string]string{
+		name:       summary,
+		compressed: base64.StdEncoding.EncodeToString(b.Bytes()),
+	}
+}
+
+// progress returns the status description and the suffix, used for both the
+// status and the gist descriptions, given the number of checks done out of
+// total and the number of failures so far.
+//
+// Returns true when all the checks are done. total is 0 while setting up.
+func progress(checkNum, total, failed int) (string, string, bool) {
+	if total == 0 {
+		if failed != 0 {
+			// Still setting up, yet failed.
+			return "Setting up", " FAILED", false
+		}
+		return "Setting up", "", false
+	}
+	if checkNum != total {
+		// github already prepends the status with "Pending -".
+		suffix := ""
+		if failed != 0 {
+			suffix = " FAILED"
+		}
+		return "Running", suffix + fmt.Sprintf(" (%d/%d)", checkNum, total), false
+	}
+	// Last check.
+	if failed == 0 {
+		return "Success", fmt.Sprintf(" (%d/%d)", total, total), true
+	}
+	return "FAILED", fmt.Sprintf(" %d out of %d", failed, total), true
+}
+
+// maxStatusDesc is the maximum length of a status description. GitHub
+// truncates longer ones.
+const maxStatusDesc = 140
+
+// statusDescription returns desc followed by as many names as fits in
+// maxStatusDesc characters, summarizing the remaining ones.
+func statusDescription(desc string, names []string) string {
+	for n := len(names); n > 0; n-- {
+		s := desc + ": " + strings.Join(names[:n], ", ")
+		if n != len(names) {
+			s += fmt.Sprintf(", +%d more", len(names)-n)
+		}
+		if utf8.RuneCountInString(s) <= maxStatusDesc {
+			return s
+		}
+	}
+	if utf8.RuneCountInString(desc) <= maxStatusDesc {
+		return desc
+	}
+	// Truncate at a word boundary.
+	s := string([]rune(desc)[:maxStatusDesc-1])
+	if i := strings.LastIndexByte(s, ' '); i > 0 {
+		s = s[:i]
+	}
+	return s + "…"
+}
+
+// checkName returns a short name for a check, e.g. "test" for "go test ./...".
+func checkName(c gohci.Check) string {
+	if len(c.Cmd) == 0 {
+		return ""
+	}
+	if isGo(c.Cmd[0]) && len(c.Cmd) > 1 {
+		return c.Cmd[1]
+	}
+	return strings.TrimSuffix(filepath.Base(c.Cmd[0]), ".exe")
+}
+
+// addGoTestFlags returns a copy of checks with flags added to the "go test"
+// commands, unless opted out.
+func addGoTestFlags(checks []gohci.Check, flags []string) []gohci.Check {
+	out := make([]gohci.Check, len(checks))
+	for i, c := range checks {
+		if !c.NoGoTestFlags && len(c.Cmd) > 1 && isGo(c.Cmd[0]) && c.Cmd[1] == "test" {
+			cmd := make([]string, 0, len(c.Cmd)+len(flags))
+			cmd = append(cmd, c.Cmd[:2]...)
+			cmd = append(cmd, flags...)
+			c.Cmd = append(cmd, c.Cmd[2:]...)
+		}
+		out[i] = c
+	}
+	return out
+}
+
 // cmds returns the list of commands to attach to the metadata gist as a single
 // indented string.
 func cmds(checks []gohci.Check) string {
@@ -324,3 +1050,31 @@ func cmds(checks []gohci.Check) string {
 	}
 	return cmds
 }
+
+// combineStates returns the combined state of statuses, ignoring the ones for
+// context ignore.
+//
+// It is "failure" if any is "error" or "failure", "pending" if any is pending
+// and "success" if all are successful. Returns "" if there is no status.
+func combineStates(statuses []*github.RepoStatus, ignore ...string) string {
+	state := ""
+loop:
+	for _, s := range statuses {
+		for _, i := range ignore {
+			if s.GetContext() == i {
+				continue loop
+			}
+		}
+		switch s.GetState() {
+		case "error", "failure":
+			return "failure"
+		case "pending":
+			state = "pending"
+		case "success":
+			if state == "" {
+				state = "success"
+			}
+		}
+	}
+	return state
+}
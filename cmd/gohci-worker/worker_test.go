@@ -0,0 +1,264 @@
+// Copyright 2020 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/go-github/v31/github"
+	"periph.io/x/gohci"
+)
+
+func TestCombineStates(t *testing.T) {
+	st := func(ctx, state string) *github.RepoStatus {
+		return &github.RepoStatus{Context: github.String(ctx), State: github.String(state)}
+	}
+	data := []struct {
+		in       []*github.RepoStatus
+		expected string
+	}{
+		{nil, ""},
+		{[]*github.RepoStatus{st("me", "failure")}, ""},
+		{[]*github.RepoStatus{st("me", "failure"), st("travis", "success")}, "success"},
+		{[]*github.RepoStatus{st("travis", "success"), st("appveyor", "pending")}, "pending"},
+		{[]*github.RepoStatus{st("travis", "pending"), st("appveyor", "error")}, "failure"},
+		{[]*github.RepoStatus{st("travis", "success"), st("appveyor", "failure")}, "failure"},
+		{[]*github.RepoStatus{st("me (create)", "failure"), st("travis", "success")}, "success"},
+	}
+	for i, l := range data {
+		if s := combineStates(l.in, "me", "me (create)"); s != l.expected {
+			t.Fatalf("#%d: combineStates() = %q; not %q", i, s, l.expected)
+		}
+	}
+}
+
+func TestGistsToDelete(t *testing.T) {
+	now := time.Now()
+	g := func(id, desc string, age time.Duration) *github.Gist {
+		c := now.Add(-age)
+		return &github.Gist{ID: github.String(id), Description: github.String(desc), CreatedAt: &c}
+	}
+	gists := []*github.Gist{
+		g("1", "w for https://github.com/o/r/commit/1 in 1s", 3*time.Hour),
+		g("2", "w for https://github.com/o/r/pull/1 at https://github.com/o/r/commit/2", time.Hour),
+		g("3", "w for https://github.com/o/r2/commit/3", 4*time.Hour),
+		g("4", "other for https://github.com/o/r/commit/4", 5*time.Hour),
+		g("5", "w for https://github.com/o/r/commit/5", 2*time.Hour),
+		g("6", "unrelated", 6*time.Hour),
+	}
+	prefix := "w for https://github.com/o/r/"
+	if d := gistsToDelete(gists, prefix, 3, nil); len(d) != 0 {
+		t.Fatalf("unexpected %v", d)
+	}
+	d := gistsToDelete(gists, prefix, 1, nil)
+	if len(d) != 2 || d[0].GetID() != "5" || d[1].GetID() != "1" {
+		t.Fatalf("unexpected %v", d)
+	}
+	// The gists still in use are kept.
+	d = gistsToDelete(gists, prefix, 1, map[string]bool{"5": true})
+	if len(d) != 1 || d[0].GetID() != "1" {
+		t.Fatalf("unexpected %v", d)
+	}
+}
+
+func TestStatusDescription(t *testing.T) {
+	long := strings.Repeat("abcdefghi ", 20)
+	data := []struct {
+		desc     string
+		names    []string
+		expected string
+	}{
+		{"Success (1/1) in 1s", nil, "Success (1/1) in 1s"},
+		{"FAILED 2 out of 4 in 1s", []string{"vet", "test"}, "FAILED 2 out of 4 in 1s: vet, test"},
+		{
+			"Success (4/4) in 1s",
+			[]string{"lint", "vet", "test", long},
+			"Success (4/4) in 1s: lint, vet, test, +1 more",
+		},
+		{long, nil, long[:129] + "…"},
+		{long, []string{"test"}, long[:129] + "…"},
+	}
+	for i, l := range data {
+		s := statusDescription(l.desc, l.names)
+		if s != l.expected {
+			t.Fatalf("#%d: statusDescription() = %q; not %q", i, s, l.expected)
+		}
+		if n := utf8.RuneCountInString(s); n > maxStatusDesc {
+			t.Fatalf("#%d: too long: %d", i, n)
+		}
+	}
+}
+
+func TestCheckName(t *testing.T) {
+	data := []struct {
+		in       []string
+		expected string
+	}{
+		{nil, ""},
+		{[]string{"go", "test", "./..."}, "test"},
+		{[]string{"go.exe", "vet"}, "vet"},
+		{[]string{"/usr/bin/golint", "./..."}, "golint"},
+		{[]string{"go"}, "go"},
+	}
+	for i, l := range data {
+		if s := checkName(gohci.Check{Cmd: l.in}); s != l.expected {
+			t.Fatalf("#%d: checkName(%v) = %q; not %q", i, l.in, s, l.expected)
+		}
+	}
+}
+
+func TestAddGoTestFlags(t *testing.T) {
+	in := []gohci.Check{
+		{Cmd: []string{"go", "test", "-count=2", "./..."}},
+		{Cmd: []string{"go", "vet", "./..."}},
+		{Cmd: []string{"go", "test", "./..."}, NoGoTestFlags: true},
+		{Cmd: []string{"./test", "test"}},
+	}
+	expected := []gohci.Check{
+		{Cmd: []string{"go", "test", "-race", "-count=1", "-count=2", "./..."}},
+		{Cmd: []string{"go", "vet", "./..."}},
+		{Cmd: []string{"go", "test", "./..."}, NoGoTestFlags: true},
+		{Cmd: []string{"./test", "test"}},
+	}
+	out := addGoTestFlags(in, []string{"-race", "-count=1"})
+	if !reflect.DeepEqual(out, expected) {
+		t.Fatalf("unexpected %v", out)
+	}
+	// The input must not be modified.
+	if len(in[0].Cmd) != 4 {
+		t.Fatalf("input modified: %v", in[0].Cmd)
+	}
+}
+
+func TestArtifactsComment(t *testing.T) {
+	links := map[string]string{
+		"artifact-report.html": "https://gist/raw/report.html",
+		"artifact-bin_foo.b64": "https://gist/raw/bin_foo.b64",
+	}
+	expected := "<!-- m -->\n### title\n\n" +
+		"- [bin_foo.b64](https://gist/raw/bin_foo.b64) (decode with `base64 -d`)\n" +
+		"- [report.html](https://gist/raw/report.html)\n"
+	if s := artifactsComment("<!-- m -->", "title", links); s != expected {
+		t.Fatalf("unexpected %q", s)
+	}
+}
+
+func TestCompressGistFile(t *testing.T) {
+	var lines []string
+	for i := 0; i < 100; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+	content := strings.Join(lines, "\n") + "\n"
+	out := compressGistFile("cmd1 in 1s", content)
+	if len(out) != 2 {
+		t.Fatalf("unexpected %v", out)
+	}
+	b, err := base64.StdEncoding.DecodeString(out["cmd1 in 1s.gz.b64"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != content {
+		t.Fatalf("unexpected %q", raw)
+	}
+	summary := out["cmd1 in 1s"]
+	if !strings.Contains(summary, "base64 -d < \"cmd1 in 1s.gz.b64\" | gunzip") {
+		t.Fatalf("missing instructions: %q", summary)
+	}
+	if !strings.Contains(summary, "line 9\n<... 60 lines ...>\nline 70\n") || !strings.HasSuffix(summary, "line 99\n") {
+		t.Fatalf("unexpected summary: %q", summary)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	data := []struct {
+		checkNum, total, failed int
+		desc, suffix            string
+		done                    bool
+	}{
+		{0, 0, 0, "Setting up", "", false},
+		{0, 0, 1, "Setting up", " FAILED", false},
+		// Setup steps after the checks are listed, e.g. setup-2-secrets or
+		// setup-2-manifest, must not make it look like the checks completed.
+		{0, 1, 0, "Running", " (0/1)", false},
+		{1, 3, 1, "Running", " FAILED (1/3)", false},
+		{2, 2, 0, "Success", " (2/2)", true},
+		{2, 2, 1, "FAILED", " 1 out of 2", true},
+	}
+	for i, l := range data {
+		desc, suffix, done := progress(l.checkNum, l.total, l.failed)
+		if desc != l.desc || suffix != l.suffix || done != l.done {
+			t.Fatalf("#%d: progress(%d, %d, %d) = %q, %q, %t", i, l.checkNum, l.total, l.failed, desc, suffix, done)
+		}
+	}
+}
+
+func TestBuiltCommits(t *testing.T) {
+	b := builtCommits{}
+	for i := 0; i < maxBuiltPRs+1; i++ {
+		b.add(fmt.Sprintf("o/r#%d", i), "c", &github.RepoStatus{})
+	}
+	// Updating a PR makes it the most recent.
+	b.add("o/r#1", "c2", &github.RepoStatus{})
+	b.add("o/r2#1", "c", &github.RepoStatus{})
+	if len(b.m) != maxBuiltPRs || len(b.prs) != maxBuiltPRs {
+		t.Fatalf("unexpected %d %d", len(b.m), len(b.prs))
+	}
+	if b.pop("o/r#0") != nil || b.pop("o/r#2") != nil {
+		t.Fatal("the oldest PRs must be evicted")
+	}
+	if s := b.pop("o/r#1"); len(s) != 2 {
+		t.Fatalf("unexpected %v", s)
+	}
+	if b.pop("o/r#1") != nil || len(b.prs) != maxBuiltPRs-1 {
+		t.Fatal("pop must forget the PR")
+	}
+}
+
+func TestSupersede(t *testing.T) {
+	newJob := func(pullID int, commit string) *jobRequest {
+		ctx, cancel := context.WithCancel(context.Background())
+		return &jobRequest{org: "o", repo: "r", pullID: pullID, commitHash: commit, ctx: ctx, cancel: cancel}
+	}
+	old := newJob(1, "111111111111111")
+	other := newJob(2, "222222222222222")
+	same := newJob(1, "333333333333333")
+	w := &workerQueue{jobs: map[*jobRequest]struct{}{old: {}, other: {}, same: {}}}
+	w.built.add("o/r#1", "444444444444444", &github.RepoStatus{State: github.String("success")})
+	w.built.add("o/r#1", "333333333333333", &github.RepoStatus{State: github.String("failure")})
+	w.built.add("o/r#2", "555555555555555", &github.RepoStatus{})
+
+	j := newJob(1, "333333333333333")
+	stale := w.supersede(j)
+	if old.ctx.Err() == nil || old.cancelDesc != "Superseded by 333333333333" {
+		t.Fatalf("the previous commit must be canceled: %q", old.cancelDesc)
+	}
+	if other.ctx.Err() != nil || same.ctx.Err() != nil {
+		t.Fatal("other PRs and the same commit must not be canceled")
+	}
+	if len(stale) != 1 || stale["444444444444444"].GetState() != "success" {
+		t.Fatalf("unexpected %v", stale)
+	}
+	if w.built.pop("o/r#1") != nil || w.built.pop("o/r#2") == nil {
+		t.Fatal("only the PR must be forgotten")
+	}
+}
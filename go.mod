@@ -3,6 +3,7 @@ module periph.io/x/gohci
 go 1.13
 
 require (
+	github.com/creack/pty v1.1.11
 	github.com/fsnotify/fsnotify v1.4.9 // indirect
 	github.com/golang/protobuf v1.4.2 // indirect
 	github.com/google/go-github/v31 v31.0.0
@@ -11,6 +11,8 @@
 // secret and OAuth2 access token.
 package gohci
 
+import "time"
+
 // WorkerConfig is a worker configuration.
 //
 // It is found as `gohci.yml` in the gohci-worker working directory.
@@ -33,6 +35,169 @@ type WorkerConfig struct {
 	//
 	// Defaults to the machine hostname.
 	Name string
+	// CombinedStatus controls how the statuses posted by other CI systems on
+	// the same commit are taken into account before notifying a failure.
+	// Valid values are:
+	//
+	// - "": other statuses are ignored. This is the default.
+	//
+	// - "defer": do not notify a failure if all the other status contexts on
+	// the commit are successful.
+	//
+	// - "wait": same as "defer" but first wait for the other status contexts to
+	// complete, up to 10 minutes.
+	CombinedStatus string
+	// IgnoreDraftPRs tells to not test draft PRs until they are marked as ready
+	// for review. When a PR is converted back to draft, its enqueued and
+	// running checks are canceled.
+	IgnoreDraftPRs bool
+	// SupersedePRCommits tells to cancel the enqueued and running checks of the
+	// previous commits of a PR when it is updated, e.g. force-pushed. The status
+	// of the previous commits that were built is marked as superseded instead of
+	// staying pending or stale.
+	SupersedePRCommits bool
+	// MaxGistsPerRepo is the maximum number of gists to keep per repository.
+	// When a build completes, the oldest gists created by this worker for the
+	// repository are deleted, except the ones still in use by other builds.
+	//
+	// Defaults to 0, which means unlimited.
+	MaxGistsPerRepo int
+	// GistCompressThreshold is the size in bytes above which the output of a
+	// step is stored in the gist gzip compressed and base64 encoded, as a
+	// separate ".gz.b64" file. The file with the original name then contains
+	// the first and last lines of the output and how to decompress it.
+	//
+	// Defaults to 0, which means never compressed.
+	GistCompressThreshold int
+	// QueueReports tells to still run the checks when the GitHub API is
+	// unreachable to create the gist or the commit status. The results are
+	// queued and posted once the API is reachable again. The queue is saved in
+	// gohci-pending.json so it survives restarts. A report rejected by GitHub,
+	// e.g. because the gist was deleted, or failing repeatedly with server
+	// errors is dropped.
+	//
+	// This only helps when the API is down while git over HTTPS still works:
+	// the repository is always fetched from GitHub and the checkout is deleted
+	// after the build, so nothing is built when GitHub is entirely down.
+	QueueReports bool
+	// MaxPushCommits is the maximum number of commits to test on a push, so
+	// each commit gets its own status and history stays bisectable. The most
+	// recent commits are tested. Commits already pushed in another branch are
+	// skipped. GitHub lists at most 20 commits in a push event.
+	//
+	// Defaults to 0, which means only the head commit is tested.
+	MaxPushCommits int
+	// MaxConcurrentBuilds is the maximum number of builds to run concurrently.
+	// Builds for the same repository are always run one at a time since they
+	// share the same GOPATH.
+	//
+	// All builds share the Go build cache, which is safe for concurrent use.
+	// Checks that clear the caches, like "go clean -cache", "-testcache",
+	// "-modcache" or "-fuzzcache", are run only when no other check is running.
+	//
+	// Defaults to 1.
+	MaxConcurrentBuilds int
+	// MaxGitFetches is the maximum number of concurrent git operations against
+	// github.com, like "git fetch" and "git ls-remote", independently of
+	// MaxConcurrentBuilds. This reduces the risk of being throttled by GitHub.
+	//
+	// Defaults to 0, which means unlimited.
+	MaxGitFetches int
+	// GoTestFlags are flags added to all "go test" checks, e.g. "-race" or
+	// "-count=1". They are inserted right after "test", so flags specified in
+	// the check take precedence. A check can opt out with NoGoTestFlags.
+	GoTestFlags []string
+	// DetectStatusCollision tells to check, after the first build of each
+	// repository, whether statuses with the same context as this worker's Name
+	// were posted by another account or link to something else than a gist.
+	// This happens when two workers are misconfigured with the same Name, and
+	// leads to confusing status flapping. A warning is logged.
+	DetectStatusCollision bool
+	// ReproManifest tells to add a "setup-2-manifest" file to the gist that
+	// captures everything needed to reproduce the build elsewhere: the Go
+	// version, the resolved module versions, the environment variables with
+	// secrets redacted, the commit and tree hashes and the checks.
+	ReproManifest bool
+	// CacheResults tells to not run the checks again when they already
+	// succeeded on the same source tree, e.g. when a branch is fast-forwarded
+	// or a commit is amended with only a message change. The cache key includes
+	// the Go toolchain version, the environment and the checks to run, so a
+	// toolchain upgrade or a checks change forces a rebuild. The cache is saved
+	// in gohci-cache.txt.
+	//
+	// The checks artifacts are not uploaded when the checks are skipped.
+	CacheResults bool
+	// CommentArtifacts tells to maintain a comment on the PR linking to the
+	// artifacts uploaded to the gist, so they can be downloaded in one click.
+	// The comment is updated on each push to the PR.
+	//
+	// This requires the OAuth2 access token to have the scope 'public_repo'
+	// for public repositories or 'repo' for private ones, which grants write
+	// access to the repositories.
+	CommentArtifacts bool
+	// AdaptiveTimeout kills the checks that run much longer than they usually
+	// do, e.g. because they hang.
+	AdaptiveTimeout AdaptiveTimeout
+	// CreateChecks are the commands to run when a branch or a tag is created,
+	// e.g. a quick validation. They are run instead of the repository's
+	// checks.
+	//
+	// Their status is posted with the context "<Name> (create)", since a push
+	// of a new branch also triggers a build of the same commit with the
+	// repository's checks, which keeps the "<Name>" context.
+	//
+	// Defaults to nothing, which means create events are ignored.
+	CreateChecks []Check
+	// Templates are named repository configurations that can be inherited from
+	// in Repos.
+	Templates map[string]RepoConfig
+	// Repos are the worker side configurations per repository, keyed by
+	// "<org>/<repo>".
+	Repos map[string]RepoConfig
+}
+
+// AdaptiveTimeout is the configuration to derive the timeout of each check
+// from its historical durations.
+//
+// The durations of the successful runs are saved in gohci-durations.json.
+type AdaptiveTimeout struct {
+	// Multiplier is applied to the 95th percentile of the recent durations of a
+	// check to calculate its timeout, e.g. 5.
+	//
+	// Defaults to 0, which disables the adaptive timeout.
+	Multiplier float64
+	// Max is the hard ceiling of the timeout, e.g. "1h". It is also used for
+	// checks that don't have enough historical durations yet.
+	//
+	// Defaults to 0, which means no ceiling.
+	Max time.Duration
+	// MinSamples is the number of successful runs of a check needed before its
+	// timeout is derived from its durations.
+	//
+	// Defaults to 5.
+	MinSamples int
+}
+
+// RepoConfig is the worker side configuration for a repository.
+type RepoConfig struct {
+	// Template is the name of the template in WorkerConfig.Templates to
+	// inherit from. The fields set here override the template's, except Env
+	// which is appended to the template's.
+	Template string
+	// Checks are the commands to run when the repository doesn't have a
+	// ".gohci.yml" file.
+	//
+	// Defaults to "go test ./...".
+	Checks []Check
+	// Env are additional environment variables to use for all the checks.
+	Env []string
+	// SecretsCmd is a command run on the worker before each build to fetch
+	// short-lived secrets, e.g. from a secrets manager. It must print KEY=VALUE
+	// lines on stdout. The repository is passed as GOHCI_REPO.
+	//
+	// The secrets are added to the environment of the checks and their values
+	// are redacted from the output, except values shorter than 4 characters.
+	SecretsCmd []string
 }
 
 // Check is a single command to run.
@@ -40,6 +205,35 @@ type Check struct {
 	Cmd []string // Command to run.
 	Env []string // Optional environment variables to use.
 	Dir string   // Directory to run from. Defaults to the root of the checkout.
+	// PTY runs the command under a pseudo-terminal, for tools that behave
+	// differently or hang when not connected to a terminal. Not supported on
+	// Windows.
+	PTY bool
+	// NoGoTestFlags tells to not add the worker's GoTestFlags to this check.
+	NoGoTestFlags bool
+	// When limits when the check is run. By default, the check is always run.
+	When Condition
+	// Artifacts are patterns, as supported by filepath.Glob, of files relative
+	// to the root of the checkout to upload to the gist once the checks are
+	// done, e.g. "report.html". Binary files are base64 encoded, or skipped
+	// when the repository has secrets. Secrets are redacted from text files.
+	Artifacts []string
+}
+
+// Condition is the condition under which a check is run. All the fields set
+// must match.
+type Condition struct {
+	// Files are patterns, as supported by path.Match, of which at least one must
+	// match a file changed by the commit, e.g. "*.go". A pattern without a "/"
+	// is also matched against the file name. When the changed files are not
+	// known, e.g. for PRs, this condition always matches.
+	Files []string
+	// Branches are the names of the branches on which the check is run.
+	Branches []string
+	// DefaultBranch tells to only run the check on the default branch.
+	DefaultBranch bool
+	// Tags tells to only run the check for tags.
+	Tags bool
 }
 
 // ProjectWorkerConfig is the project configuration via ".gohci.yml" for a